@@ -0,0 +1,551 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/charmbracelet/x/term"
+	"github.com/muesli/termenv"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+
+	"rbcp/robocopy"
+)
+
+// # --bugreport and rbcp bugreport
+// A run with --bugreport captures what it takes to debug it in the bugreport directory of the state directory,
+// replacing the previous capture: its command line, the effective config, rbcp's log at every level and a recording of
+// robocopy's output (see --record). When the run ends, it bundles the capture with the version of rbcp and the OS and
+// terminal it runs on into a zip, as rbcp bugreport does for the last capture (e.g. after a crash).
+//
+//	report.json    versions, OS, terminal, command line and the arguments of every robocopy run
+//	config.toml    the effective config, with where every key comes from
+//	debug.log      rbcp's log
+//	recording.rec  robocopy's raw output, see rbcp replay
+//
+// With --anonymize, every name in a path is replaced by a hash keyed for the report, keeping drive letters,
+// separators and extensions, so the structure of the paths survives but not the names.
+
+// bugreport is the capture of this run with --bugreport, nil without it
+var bugreport *bugreportSession
+
+// bugreportSession is the capture of a run for a bug report
+type bugreportSession struct {
+	Args      []string  `json:"args"`
+	Started   time.Time `json:"started"`
+	Recording string    `json:"recording,omitempty"`
+
+	dir  string
+	done bool
+}
+
+// bugreportDir returns the directory --bugreport captures the run in
+func bugreportDir() string {
+	return filepath.Join(stateDir(), "bugreport")
+}
+
+// startBugreport starts capturing the run: its command line and rbcp's log at every level, see saveConfig
+func startBugreport() *bugreportSession {
+	s := &bugreportSession{Args: os.Args, Started: time.Now(), dir: bugreportDir()}
+	os.RemoveAll(s.dir)
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		logger.Fatalf("Cannot capture this run for a bug report: %v", err)
+	}
+	f, err := os.Create(filepath.Join(s.dir, "debug.log"))
+	if err != nil {
+		logger.Fatalf("Cannot capture this run for a bug report: %v", err)
+	}
+	logger.SetOutput(&levelWriter{out: os.Stderr, file: f, level: logger.GetLevel(), onFatal: s.finishFatal})
+	logger.SetColorProfile(colorProfile)
+	logger.SetLevel(log.DebugLevel)
+
+	s.save()
+	logger.Debugf("Capturing this run for a bug report in %v", s.dir)
+	return s
+}
+
+// saveConfig captures the effective config, once it is loaded. Without it (e.g. when loading it fails) the bug report
+// holds the config as far as it was loaded.
+func (s *bugreportSession) saveConfig() {
+	if s == nil {
+		return
+	}
+	cfg, err := effectiveConfig()
+	if err == nil {
+		err = os.WriteFile(filepath.Join(s.dir, "config.toml"), cfg, 0o644)
+	}
+	if err != nil {
+		logger.Warnf("Could not save the config for the bug report: %v", err)
+	}
+}
+
+// record makes the run record robocopy's output for the bug report, to the file of --record if given
+func (s *bugreportSession) record() {
+	if args.Record == "" {
+		args.Record = filepath.Join(s.dir, "recording.rec")
+	}
+	s.Recording, _ = filepath.Abs(args.Record)
+	s.save()
+}
+
+func (s *bugreportSession) save() {
+	data, _ := json.MarshalIndent(s, "", "  ")
+	if err := os.WriteFile(filepath.Join(s.dir, "session.json"), data, 0o644); err != nil {
+		logger.Warnf("Could not save the command line for the bug report: %v", err)
+	}
+}
+
+// finish bundles the capture when the run ends, nothing without --bugreport
+func (s *bugreportSession) finish() {
+	if s == nil || s.done {
+		return
+	}
+	s.done = true
+	path := bugreportName()
+	if err := writeBugreport(path, s.dir, "", false, logger.Warnf); err != nil {
+		logger.Errorf("Could not write the bug report: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nBug report written to %v, run %v to hash the paths in it\n",
+		pathStyle.Render(path), impStyle.Render("rbcp bugreport --anonymize"))
+}
+
+// finishFatal bundles the capture on a fatal error, from inside the logger, which it must not log to
+func (s *bugreportSession) finishFatal() {
+	if s.done {
+		return
+	}
+	s.done = true
+	path := bugreportName()
+	warn := func(format string, v ...any) { fmt.Fprintf(os.Stderr, format+"\n", v...) }
+	if err := writeBugreport(path, s.dir, "", false, warn); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the bug report: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Bug report written to %v\n", path)
+}
+
+// bugreportName returns the default file name of a bug report
+func bugreportName() string {
+	return "rbcp-bugreport-" + time.Now().Format("20060102-150405") + ".zip"
+}
+
+// effectiveConfig returns the config with where every key comes from, and the preset applied to the run
+func effectiveConfig() ([]byte, error) {
+	data, err := annotatedConfig(func(s ...string) string { return strings.Join(s, " ") })
+	if err != nil {
+		return nil, fmt.Errorf("could not encode config: %w", err)
+	}
+	buf := bytes.NewBuffer(data)
+	buf.WriteString("\n")
+	if err := toml.NewEncoder(buf).Encode(struct{ Effective Preset }{opts}); err != nil {
+		return nil, fmt.Errorf("could not encode config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// levelWriter writes every log entry to file, with the time, and to out those at level or above, as the logger logs
+// at every level while capturing a run
+type levelWriter struct {
+	out     io.Writer
+	file    io.Writer
+	level   log.Level
+	onFatal func()
+}
+
+// entryLevels are the levels of log entries by the start of their prefix
+var entryLevels = map[string]log.Level{
+	"DEBU": log.DebugLevel,
+	"INFO": log.InfoLevel,
+	"WARN": log.WarnLevel,
+	"ERRO": log.ErrorLevel,
+	"FATA": log.FatalLevel,
+}
+
+// Write writes an entry, which the logger writes at once
+func (w *levelWriter) Write(p []byte) (int, error) {
+	entry := strings.TrimLeft(ansi.Strip(string(p)), " ")
+	fmt.Fprintf(w.file, "%v %v", time.Now().Format("15:04:05.000"), entry)
+	level, known := log.Level(0), false
+	if len(entry) >= 4 {
+		level, known = entryLevels[entry[:4]]
+	}
+	if !known || level >= w.level {
+		w.out.Write(p)
+	}
+	if known && level == log.FatalLevel && w.onFatal != nil {
+		w.onFatal()
+	}
+	return len(p), nil
+}
+
+// # rbcp bugreport
+
+type BugreportCmd struct {
+	CommonFlags
+	Output    string `arg:"-o,--output" placeholder:"FILE" help:"zip file to write [default: rbcp-bugreport-TIME.zip]"`
+	Anonymize bool   `arg:"--anonymize" help:"replace the names in paths by hashes, keeping drive letters, separators and extensions"`
+	Recording string `arg:"--recording" placeholder:"FILE" help:"bundle this recording (see --record) instead of the one of the last --bugreport run"`
+}
+
+func (BugreportCmd) Description() string {
+	return "Bundle the last run with --bugreport, the config and the OS and terminal rbcp runs on into a zip to attach to a bug report.\n"
+}
+
+func runBugreportCmd(argv []string) {
+	var cmd BugreportCmd
+	parseSubcommand("bugreport", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	setup()
+	if cmd.Output == "" {
+		cmd.Output = bugreportName()
+	}
+	dir := bugreportDir()
+	if _, err := os.Stat(dir); err != nil && cmd.Recording == "" {
+		logger.Warnf("No run was captured with --bugreport, the report holds no logs nor robocopy output")
+	}
+	if err := writeBugreport(cmd.Output, dir, cmd.Recording, cmd.Anonymize, logger.Warnf); err != nil {
+		logger.Fatalf("Could not write the bug report: %v", err)
+	}
+	fmt.Printf("Bug report written to %v\n", pathStyle.Render(cmd.Output))
+}
+
+// bugReport is the report.json of a bug report
+type bugReport struct {
+	Created    time.Time      `json:"created"`
+	Version    string         `json:"version"`
+	Commit     string         `json:"commit"`
+	BuildDate  string         `json:"build_date"`
+	Go         string         `json:"go"`
+	OS         string         `json:"os"`
+	OSVersion  string         `json:"os_version,omitempty"`
+	Terminal   terminalReport `json:"terminal"`
+	Args       []string       `json:"args,omitempty"`
+	Started    *time.Time     `json:"started,omitempty"`
+	Robocopy   [][]string     `json:"robocopy_args,omitempty"`
+	Config     []string       `json:"config_files,omitempty"`
+	Anonymized bool           `json:"anonymized"`
+}
+
+// terminalReport describes the terminal rbcp runs in
+type terminalReport struct {
+	Stdin        bool              `json:"stdin_is_terminal"`
+	Stdout       bool              `json:"stdout_is_terminal"`
+	Stderr       bool              `json:"stderr_is_terminal"`
+	Width        int               `json:"width,omitempty"`
+	Height       int               `json:"height,omitempty"`
+	ColorProfile string            `json:"color_profile"`
+	Encoding     string            `json:"encoding"`
+	Env          map[string]string `json:"env"`
+}
+
+// terminalEnv are the environment variables describing the terminal and the locale
+var terminalEnv = []string{"TERM", "COLORTERM", "TERM_PROGRAM", "TERM_PROGRAM_VERSION", "WT_SESSION", "ConEmuANSI",
+	"NO_COLOR", "COLUMNS", "LANG", "LC_ALL", "LC_CTYPE", "LOGLEVEL"}
+
+func newTerminalReport() terminalReport {
+	t := terminalReport{
+		Stdin:        term.IsTerminal(os.Stdin.Fd()),
+		Stdout:       term.IsTerminal(os.Stdout.Fd()),
+		Stderr:       term.IsTerminal(os.Stderr.Fd()),
+		ColorProfile: profileName(colorProfile),
+		Encoding:     robocopy.DefaultEncoding(),
+		Env:          map[string]string{},
+	}
+	t.Width, t.Height, _ = term.GetSize(os.Stdout.Fd())
+	for _, name := range terminalEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Env[name] = value
+		}
+	}
+	return t
+}
+
+func profileName(profile termenv.Profile) string {
+	switch profile {
+	case termenv.TrueColor:
+		return "truecolor"
+	case termenv.ANSI256:
+		return "ansi256"
+	case termenv.ANSI:
+		return "ansi"
+	}
+	return "ascii"
+}
+
+// writeBugreport bundles the capture in dir, which may not exist, with a report on this machine into the zip at path.
+// recording, if set, replaces the recording of the capture. It reports problems that do not prevent the bundle to warn
+// and never logs, as it runs inside the logger on a fatal error.
+func writeBugreport(path, dir, recording string, anonymize bool, warn func(format string, v ...any)) error {
+	report := bugReport{
+		Created:    time.Now(),
+		Version:    Version,
+		Commit:     Commit,
+		BuildDate:  BuildDate,
+		Go:         runtime.Version(),
+		OS:         runtime.GOOS + "/" + runtime.GOARCH,
+		OSVersion:  osVersion(),
+		Terminal:   newTerminalReport(),
+		Anonymized: anonymize,
+	}
+	for _, layer := range configLayers(args.ConfigFlags) {
+		if _, err := os.Stat(layer.Path); err == nil {
+			report.Config = append(report.Config, layer.Path)
+		}
+	}
+
+	var session bugreportSession
+	if data, err := os.ReadFile(filepath.Join(dir, "session.json")); err == nil {
+		if err := json.Unmarshal(data, &session); err != nil {
+			warn("Ignoring the invalid capture in %v: %v", dir, err)
+		}
+		report.Args, report.Started = session.Args, &session.Started
+	}
+	if recording == "" {
+		recording = session.Recording
+		// : the run ended before robocopy started
+		if _, err := os.Stat(recording); err != nil {
+			recording = ""
+		}
+	}
+	var header recordEntry
+	var runs []recordedRun
+	if recording != "" {
+		var err error
+		if header, runs, err = readRecording(recording); err != nil {
+			return fmt.Errorf("cannot read the recording: %w", err)
+		}
+		for _, run := range runs {
+			report.Robocopy = append(report.Robocopy, run.Args)
+		}
+	}
+
+	anon := func(s string) string { return s }
+	if anonymize {
+		known := []string{}
+		if header.Job != nil {
+			known = append(known, header.Root, header.Job.Dest)
+			known = append(known, header.Job.Sources...)
+		}
+		home, _ := os.UserHomeDir()
+		cwd, _ := os.Getwd()
+		known = append(known, home, cwd)
+		anon = newAnonymizer(known...).text
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	add := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: report.Created})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if err := add("report.json", []byte(anon(string(data))+"\n")); err != nil {
+		return err
+	}
+	// : the config of the run, or of this machine if none was captured
+	cfg, err := os.ReadFile(filepath.Join(dir, "config.toml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		cfg, err = effectiveConfig()
+	}
+	if err != nil {
+		return err
+	}
+	if err := add("config.toml", []byte(anon(string(cfg)))); err != nil {
+		return err
+	}
+	if debugLog, err := os.ReadFile(filepath.Join(dir, "debug.log")); err == nil {
+		if err := add("debug.log", []byte(anon(string(debugLog)))); err != nil {
+			return err
+		}
+	}
+	if recording != "" {
+		var rec []byte
+		if anonymize {
+			rec, err = anonymizeRecording(header, runs, anon)
+		} else {
+			rec, err = os.ReadFile(recording)
+		}
+		if err != nil {
+			return err
+		}
+		if err := add("recording.rec", rec); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// anonymizeRecording returns the recording with anon applied to its header, the arguments and the output of every
+// run, which it transcodes to UTF-8. Chunks keep their time, but lines split across chunks end up in the last one.
+func anonymizeRecording(header recordEntry, runs []recordedRun, anon func(string) string) ([]byte, error) {
+	enc, err := robocopy.LookupEncoding(header.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	write := func(e recordEntry) {
+		data, _ := json.Marshal(e)
+		out.WriteString(anon(string(data)) + "\n")
+	}
+	header.Encoding = "UTF-8"
+	write(header)
+	for i, run := range runs {
+		write(recordEntry{Run: i + 1, T: run.T, Args: run.Args})
+
+		var head, decoded bytes.Buffer
+		var decoder io.WriteCloser
+		pending := ""
+		emit := func(t float64, flush bool) {
+			pending += decoded.String()
+			decoded.Reset()
+			end := strings.LastIndexAny(pending, "\r\n") + 1
+			if flush {
+				end = len(pending)
+			}
+			if end > 0 {
+				write(recordEntry{Run: i + 1, T: t, Data: []byte(anon(pending[:end]))})
+				pending = pending[end:]
+			}
+		}
+		for j, c := range run.Chunks {
+			// : the encoding is detected from the first bytes of the output, like when reading it
+			if decoder == nil {
+				head.Write(c.Data)
+				if head.Len() < 3 && j < len(run.Chunks)-1 {
+					continue
+				}
+				enc := robocopy.DetectEncoding(head.Bytes(), enc)
+				if enc == nil {
+					enc = unicode.UTF8
+				}
+				decoder = transform.NewWriter(&decoded, enc.NewDecoder())
+				c.Data = head.Bytes()
+			}
+			if _, err := decoder.Write(c.Data); err != nil {
+				return nil, fmt.Errorf("run %d: %w", i+1, err)
+			}
+			emit(c.T, false)
+		}
+		if decoder != nil {
+			if err := decoder.Close(); err != nil {
+				return nil, fmt.Errorf("run %d: %w", i+1, err)
+			}
+			emit(run.Chunks[len(run.Chunks)-1].T, true)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// anonymizer replaces the names in paths by the start of their HMAC, keyed randomly for every report: a name always
+// gives the same hash within a report, which cannot be reversed by hashing likely names
+type anonymizer struct {
+	key []byte
+	re  *regexp.Regexp
+}
+
+// newAnonymizer returns an anonymizer of windows paths (with a drive letter or UNC) and of the known absolute paths,
+// which it also recognizes with either separator
+func newAnonymizer(known ...string) *anonymizer {
+	a := &anonymizer{key: make([]byte, 32)}
+	rand.Read(a.key)
+	var prefixes []string
+	for _, path := range known {
+		path = strings.TrimRight(path, `\/`)
+		if !filepath.IsAbs(path) || len(path) < 2 {
+			continue
+		}
+		for _, p := range []string{path, strings.ReplaceAll(path, `\`, "/"), strings.ReplaceAll(path, "/", `\`)} {
+			// : in JSON
+			prefixes = append(prefixes, regexp.QuoteMeta(p), regexp.QuoteMeta(strings.ReplaceAll(p, `\`, `\\`)))
+		}
+	}
+	// : the longest first, as the first alternative matching wins
+	slices.SortFunc(prefixes, func(a, b string) int { return len(b) - len(a) })
+	prefixes = append(prefixes, `\b[A-Za-z]:[\\/]`, `\\\\[^\\/\s"]+`)
+	a.re = regexp.MustCompile(`(?m)(?:` + strings.Join(slices.Compact(prefixes), "|") + `)` + rePathRest)
+	return a
+}
+
+// rePathRest matches the rest of a path. Names with spaces are followed by a separator, or end the path at the end of
+// the line, a tab or a quote (and take it along), as robocopy prints paths, so that lists of arguments split on spaces.
+// A ] without a [ in the last name ends a list of arguments too.
+const rePathRest = `(?:` + reName + `[\\/]|[\\/])*(?:` + reName + `(?:$|["\t\r])|[^\t\r\n"<>|?*: \\/]*)`
+
+// reName matches a name, possibly with spaces, but none of the characters invalid in names
+const reName = `[^\t\r\n"<>|?*: \\/]+(?: +[^\t\r\n"<>|?*: \\/]+)*`
+
+// text returns s with the paths in it anonymized
+func (a *anonymizer) text(s string) string {
+	return a.re.ReplaceAllStringFunc(s, a.path)
+}
+
+// path anonymizes every name of path, and keeps the character ending it, see rePathRest
+func (a *anonymizer) path(path string) string {
+	end := ""
+	last := path[strings.LastIndexAny(path, `\/`)+1:]
+	if strings.ContainsAny(path[len(path)-1:], "\"\t\r") || strings.HasSuffix(last, "]") && !strings.Contains(last, "[") {
+		path, end = path[:len(path)-1], path[len(path)-1:]
+	}
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i] == '/' || path[i] == '\\' {
+			b.WriteString(a.name(path[start:i]))
+			if i < len(path) {
+				b.WriteByte(path[i])
+			}
+			start = i + 1
+		}
+	}
+	return b.String() + end
+}
+
+// reDrive matches a drive letter
+var reDrive = regexp.MustCompile(`^[A-Za-z]:$`)
+
+// name returns the hash of name, with its extension, or name itself for a drive letter, . and ..
+func (a *anonymizer) name(name string) string {
+	if name == "" || name == "." || name == ".." || reDrive.MatchString(name) {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if ext == name || len(ext) > 8 || strings.ContainsAny(ext, " ") {
+		ext = ""
+	}
+	mac := hmac.New(sha256.New, a.key)
+	// : windows paths are case insensitive
+	mac.Write([]byte(strings.ToLower(strings.TrimSuffix(name, ext))))
+	return hex.EncodeToString(mac.Sum(nil))[:10] + ext
+}
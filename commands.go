@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alexflint/go-arg"
+
+	"rbcp/robocopy"
+)
+
+// subcommands are dispatched on the first argument, before the regular SRC DEST parsing, since go-arg
+// does not allow positional arguments and subcommands on the same command.
+// To copy a file that has the same name as a subcommand, prefix it with ./
+var subcommands = map[string]func(argv []string){
+	"config":    runConfigCmd,
+	"resume":    runResumeCmd,
+	"plan":      runPlanCmd,
+	"apply":     runApplyCmd,
+	"check":     runCheckCmd,
+	"diff":      runDiffCmd,
+	"summarize": runSummarizeCmd,
+	"replay":    runReplayCmd,
+	"bugreport": runBugreportCmd,
+
+	"restore-quarantine": runRestoreQuarantineCmd,
+}
+
+// parseSubcommand parses argv into dest, using "rbcp NAME" as the program name in help/usage
+func parseSubcommand(name string, argv []string, dest any) *arg.Parser {
+	parser, err := arg.NewParser(arg.Config{Program: ProgramName + " " + name}, dest)
+	if err != nil {
+		logger.Fatalf("could not build parser for %v: %v", name, err)
+	}
+	parser.MustParse(argv)
+	return parser
+}
+
+// # rbcp config
+
+type ConfigCmd struct {
+	CommonFlags
+	Init     *ConfigInitCmd     `arg:"subcommand:init" help:"write a commented default config file"`
+	Show     *struct{}          `arg:"subcommand:show" help:"show the effective config and where each value comes from"`
+	Validate *ConfigValidateCmd `arg:"subcommand:validate" help:"check the config file for unknown keys, invalid colors and wrong types"`
+	Path     *struct{}          `arg:"subcommand:path" help:"print the path of the config file"`
+}
+
+type ConfigInitCmd struct {
+	Force bool `arg:"-f" help:"overwrite an existing config file"`
+}
+
+type ConfigValidateCmd struct {
+	File string `arg:"positional" help:"config file to validate [default: all loaded config files and RBCP_* overrides]"`
+}
+
+func runConfigCmd(argv []string) {
+	var cmd ConfigCmd
+	parser := parseSubcommand("config", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	setup()
+
+	switch {
+	case cmd.Init != nil:
+		path := cmd.ConfigPath
+		if path == "" {
+			path = userConfigPath()
+		}
+		configInit(path, cmd.Init.Force)
+	case cmd.Show != nil:
+		configShow()
+	case cmd.Validate != nil:
+		problems := make([]string, 0)
+		if cmd.Validate.File != "" {
+			problems = validateConfigFile(cmd.Validate.File)
+		} else {
+			for _, layer := range configLayers(cmd.ConfigFlags) {
+				if _, err := os.Stat(layer.Path); err != nil && layer.Name != "--config" {
+					continue
+				}
+				for _, problem := range validateConfigFile(layer.Path) {
+					problems = append(problems, layer.Path+": "+problem)
+				}
+			}
+			problems = append(problems, validateEnv()...)
+		}
+		if len(problems) == 0 {
+			fmt.Println(impStyle.Render("Config is valid"))
+			return
+		}
+		for _, problem := range problems {
+			fmt.Println(errorStyle.Render("✗ ") + problem)
+		}
+		os.Exit(1)
+	case cmd.Path != nil:
+		layers := configLayers(cmd.ConfigFlags)
+		if len(layers) == 0 {
+			fmt.Fprintln(os.Stderr, helpStyle.Render("(no config files are loaded with --no-config)"))
+		}
+		for _, layer := range layers {
+			status := ""
+			if _, err := os.Stat(layer.Path); err != nil {
+				status = helpStyle.Render(" (does not exist)")
+			}
+			fmt.Println(fixedWidth.Render(layer.Name) + " " + layer.Path + status)
+		}
+		if cmd.ConfigPath == "" && !cmd.NoConfig && projectConfigPath() == "" {
+			fmt.Println(fixedWidth.Render("project") + " " + helpStyle.Render("(no .rbcp.toml in this or any parent directory)"))
+		}
+	default:
+		parser.Fail("missing subcommand, one of: init, show, validate, path")
+	}
+}
+
+// configComments documents the keys written by `rbcp config init`
+var configComments = map[string]string{
+	"usenerdfontarrow":     "Use a nerd font arrow between source and destination (needs a nerd font) instead of -->",
+	"showprogress":         "Show the progress bar while copying",
+	"theme":                "Colors used for output, as hex (#RRGGBB) or ANSI (0-255) values, or { Light = ..., Dark = ... } to adapt to the terminal background.\n# Can also be just the name of a built-in theme, e.g. theme = \"dracula\"",
+	"theme.name":           "Built-in theme the colors are based on: default, dracula, high-contrast or mono",
+	"theme.colorneutral":   "Help text and secondary info",
+	"theme.colorprimary":   "Highlighted stats",
+	"theme.colorsecondary": "Paths",
+	"theme.colorerror":     "Errors",
+	"theme.colorprogress":  "Gradient of the progress bar",
+	"defaults":             "Copy flags applied to every run (skipped with --insane)",
+	"defaults.retries":     "Number of retries on failed copies (/R:N)",
+	"defaults.wait":        "Seconds to wait between retries (/W:N)",
+	"status_template":      "Go text/template for the progress display, empty for the default. See the readme for the available fields and funcs",
+	"summary_template":     "Go text/template for the final report, empty for the default",
+	"protected_paths":      "Paths never used as the destination of a mirror (or the source of a move), unless --i-know-what-im-doing is passed.\n# Case-insensitive, ~ is the home directory and ? or * match any characters, e.g. ?:/ matches all drive roots",
+	"robocopy_language":    "Language of robocopy's output: auto (detected from its header), en, de, fr or es",
+	"robocopy_encoding":    "Codepage of robocopy's output, e.g. 850 or windows-1252: auto for the console's. UTF-16 (/UNICODE) is always detected",
+}
+
+// exampleProfile is appended to the file written by `rbcp config init`
+const exampleProfile = `
+# Named presets, selected with --profile NAME and applied on top of [defaults]
+# [profiles.backup]
+#   Mir = true
+#   Threads = 16
+#   ExcludeDirs = ["node_modules", ".git"]
+#   ExcludeFiles = ["*.tmp"]
+#   Passthrough = ["/XJ"]
+#   DeleteTo = "D:/quarantine"
+`
+
+func configInit(path string, force bool) {
+	if _, err := os.Stat(path); err == nil && !force {
+		logger.Fatalf("Config file %v already exists, pass --force to overwrite it", pathStyle.Render(path))
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(defaultConfig()); err != nil {
+		logger.Fatalf("could not encode default config: %v", err)
+	}
+	out := annotateTOML(buf.Bytes(), func(key, line string) string {
+		comment, ok := configComments[key]
+		if !ok {
+			return line
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		return indent + "# " + comment + "\n" + line
+	})
+	out = append(out, exampleProfile...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logger.Fatalf("could not create config directory: %v", err)
+	}
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		logger.Fatalf("could not write config file: %v", err)
+	}
+	fmt.Println("Wrote default config to " + pathStyle.Render(path))
+}
+
+func configShow() {
+	data, err := annotatedConfig(helpStyle.Render)
+	if err != nil {
+		logger.Fatalf("could not encode config: %v", err)
+	}
+	os.Stdout.Write(data)
+}
+
+// annotatedConfig returns the effective config as toml, with where every key comes from in a comment rendered by style
+func annotatedConfig(style func(...string) string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return nil, err
+	}
+	return annotateTOML(buf.Bytes(), func(key, line string) string {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			return line
+		}
+		return line + style("  # "+keySource(key))
+	}), nil
+}
+
+// keySource returns where the value of key comes from. Keys set as a whole (e.g. theme = "dracula") take the source
+// of their parent, and tables set key by key (e.g. Light and Dark of a color) the source of their children.
+func keySource(key string) string {
+	if source, ok := configSources[key]; ok {
+		return source
+	}
+	for child, source := range configSources {
+		if strings.HasPrefix(child, key+".") {
+			return source
+		}
+	}
+	for parent := key; strings.Contains(parent, "."); {
+		parent = parent[:strings.LastIndex(parent, ".")]
+		if source, ok := configSources[parent]; ok {
+			return source
+		}
+	}
+	return "default"
+}
+
+// annotateTOML calls replace for every line of an encoded toml document, with the full dotted (lowercased) key
+// defined on that line, and replaces the line with its result. Lines that define no key get an empty key.
+func annotateTOML(data []byte, replace func(key, line string) string) []byte {
+	var out bytes.Buffer
+	table := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		key := ""
+		switch {
+		case strings.HasPrefix(trimmed, "["):
+			table = normalizeKey(strings.Trim(trimmed, "[]"))
+			key = table
+		case strings.Contains(trimmed, " = "):
+			key = normalizeKey(strings.SplitN(trimmed, " = ", 2)[0])
+			if table != "" {
+				key = table + "." + key
+			}
+		}
+		if key != "" {
+			line = replace(key, line)
+		}
+		out.WriteString(line + "\n")
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// normalizeKey converts a dotted key as written in a toml file to the form used in configSources
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, `"`, ""))
+}
+
+var reColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// validColor reports whether c is a color lipgloss understands, i.e. a hex or an ANSI color
+func validColor(c string) bool {
+	if reColor.MatchString(c) {
+		return true
+	}
+	n, err := strconv.Atoi(c)
+	return err == nil && n >= 0 && n <= 255
+}
+
+// validateConfigFile returns a list of problems found in the config file at path
+func validateConfigFile(path string) []string {
+	conf := defaultConfig()
+	md, err := toml.DecodeFile(path, &conf)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{path + " does not exist"}
+		}
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			// : includes the line number (and the offending line itself)
+			return []string{perr.ErrorWithPosition()}
+		}
+		return []string{err.Error()}
+	}
+	return validateConfig(conf, md)
+}
+
+// validateEnv returns a list of problems with the RBCP_* environment overrides
+func validateEnv() []string {
+	problems := make([]string, 0)
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if _, err := envOverride(name, value); err != nil {
+			problems = append(problems, "$"+name+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+// validateConfig checks a decoded config for keys that were not decoded and for invalid values
+func validateConfig(conf Config, md toml.MetaData) []string {
+	problems := make([]string, 0)
+	for _, key := range md.Undecoded() {
+		problems = append(problems, "unknown key "+pathStyle.Render(key.String()))
+	}
+
+	colors := map[string]Color{
+		"theme.ColorNeutral":     conf.Theme.ColorNeutral,
+		"theme.ColorPrimary":     conf.Theme.ColorPrimary,
+		"theme.ColorSecondary":   conf.Theme.ColorSecondary,
+		"theme.ColorError":       conf.Theme.ColorError,
+		"theme.ColorProgress[0]": conf.Theme.ColorProgress[0],
+		"theme.ColorProgress[1]": conf.Theme.ColorProgress[1],
+	}
+	for key, c := range colors {
+		for _, value := range []string{c.Light, c.Dark} {
+			if !validColor(value) {
+				problems = append(problems, fmt.Sprintf("invalid color %v for %v (expected #RRGGBB, #RGB or 0-255)", strconv.Quote(value), pathStyle.Render(key)))
+				break
+			}
+		}
+	}
+
+	if _, _, err := parseTemplates(conf); err != nil {
+		problems = append(problems, "invalid template: "+err.Error())
+	}
+	if _, err := robocopy.LookupLanguage(conf.RobocopyLanguage); err != nil {
+		problems = append(problems, fmt.Sprintf("%v: %v", pathStyle.Render("robocopy_language"), err))
+	}
+	if _, err := robocopy.LookupEncoding(conf.RobocopyEncoding); err != nil {
+		problems = append(problems, fmt.Sprintf("%v: %v", pathStyle.Render("robocopy_encoding"), err))
+	}
+
+	presets := map[string]Preset{"defaults": conf.Defaults}
+	for name, profile := range conf.Profiles {
+		presets["profiles."+name] = profile
+	}
+	for name, preset := range presets {
+		if preset.Threads != nil && (*preset.Threads < 1 || *preset.Threads > 128) {
+			problems = append(problems, fmt.Sprintf("%v must be between 1 and 128, got %d", pathStyle.Render(name+".Threads"), *preset.Threads))
+		}
+		if preset.Retries != nil && *preset.Retries < 0 {
+			problems = append(problems, fmt.Sprintf("%v cannot be negative", pathStyle.Render(name+".Retries")))
+		}
+		if preset.Wait != nil && *preset.Wait < 0 {
+			problems = append(problems, fmt.Sprintf("%v cannot be negative", pathStyle.Render(name+".Wait")))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// # rbcp resume
+
+type ResumeCmd struct {
+	CommonFlags
+	JobID   string        `arg:"positional" placeholder:"JOB-ID" help:"job to resume [default: the most recent one]"`
+	List    bool          `arg:"-l" help:"list the jobs that can be resumed"`
+	Timeout time.Duration `placeholder:"DURATION" help:"stop the job after this long, e.g. 2h"`
+}
+
+func runResumeCmd(argv []string) {
+	var cmd ResumeCmd
+	parseSubcommand("resume", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	initWidth := setup()
+
+	if cmd.List {
+		headers, err := listJournals()
+		if err != nil {
+			logger.Fatalf("could not list jobs: %v", err)
+		}
+		if len(headers) == 0 {
+			fmt.Println(helpStyle.Render("(no jobs to resume)"))
+		}
+		for _, h := range headers {
+			fmt.Printf("%v  %v  %v --> %v\n", impStyle.Render(h.ID), helpStyle.Render(h.Created.Format(time.DateTime)),
+				pathStyle.Render(strings.Join(h.Job.Sources, ", ")), pathStyle.Render(h.Job.Dest))
+		}
+		return
+	}
+
+	var err error
+	journal, err = loadJournal(cmd.JobID)
+	if err != nil {
+		logger.Fatalf("Cannot resume: %v", err)
+	}
+	job = journal.Job
+	job.Language, job.Encoding = config.RobocopyLanguage, config.RobocopyEncoding
+	args.Timeout, args.StallTimeout = cmd.Timeout, job.StallTimeout
+	printJobHeader(initWidth)
+
+	totalFiles, totalBytes := journal.total()
+	doneFiles, doneBytes := journal.progress()
+	remaining, inFlight := journal.remaining()
+	if len(remaining) == 0 && inFlight == "" {
+		fmt.Println("Nothing left to copy, all " + impStyle.Render(strconv.Itoa(totalFiles)+" files") + " of the job are done")
+		journal.remove()
+		return
+	}
+	fmt.Printf("Resuming job %v: %v of %v files (%v of %v) were already copied\n", impStyle.Render(journal.ID),
+		doneFiles, totalFiles, formatByteValue(doneBytes), formatByteValue(totalBytes))
+
+	jobs, unmatched, err := job.Retry(remaining)
+	if err != nil {
+		logger.Fatalf("Cannot resume: %v", err)
+	}
+	if inFlight != "" {
+		// : restartable mode continues the file that was being copied instead of starting it over
+		inFlightJobs, _, err := job.Retry([]string{inFlight})
+		if err != nil {
+			logger.Fatalf("Cannot resume: %v", err)
+		}
+		for i := range inFlightJobs {
+			inFlightJobs[i].Options.Extra = append(slices.Clone(inFlightJobs[i].Options.Extra), "/Z")
+		}
+		jobs = append(inFlightJobs, jobs...)
+	}
+	for _, path := range unmatched {
+		logger.Warnf("Cannot resume %v, it is not inside the source", path)
+	}
+
+	ctx, cancel := jobContext()
+	defer cancel()
+
+	m := newModel(totalFiles, totalBytes, initWidth)
+	m.copiedFiles, m.copiedBytes, m.resumedBytes = doneFiles, doneBytes, doneBytes
+	m.percent = float64(doneBytes) / float64(max(totalBytes, 1))
+	stats, m, stoppedErr := copyWithTUI(ctx, cancel, jobs, m)
+
+	finish(stats, nil, stoppedErr, m)
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/charmbracelet/lipgloss"
@@ -21,58 +30,372 @@ type Config struct {
 	UseNerdFontArrow bool
 	ShowProgress bool
 	Theme Theme
+	// Defaults are applied to every run, unless --insane is passed
+	Defaults Preset
+	// Profiles are named presets selected with --profile NAME, applied on top of Defaults
+	Profiles map[string]Preset
+	// StatusTemplate and SummaryTemplate customize the TUI and the final report, empty for the defaults (see templates.go)
+	StatusTemplate  string `toml:"status_template"`
+	SummaryTemplate string `toml:"summary_template"`
+	// ProtectedPaths are never mirrored, purged or moved to, see guard.go
+	ProtectedPaths []string `toml:"protected_paths"`
+	// RobocopyLanguage is the language robocopy prints its output in, see robocopy.Languages
+	RobocopyLanguage string `toml:"robocopy_language"`
+	// RobocopyEncoding is the codepage robocopy prints its output in, see robocopy.LookupEncoding
+	RobocopyEncoding string `toml:"robocopy_encoding"`
 }
 
-type Theme struct {
-	ColorNeutral string
-	ColorPrimary string
-	ColorSecondary string
-	ColorError string
-	ColorProgress [2]string
+// Preset is a set of default copy flags. Used for both [defaults] and every [profiles.NAME] section.
+// Unset (nil) values do not override anything when merging.
+type Preset struct {
+	Mir          *bool
+	Threads      *int
+	Retries      *int
+	Wait         *int
+	ExcludeFiles []string
+	ExcludeDirs  []string
+	Passthrough  []string
+	// DeleteTo is the directory extras are moved to instead of being purged, see quarantine.go
+	DeleteTo string `toml:",omitempty"`
+}
+
+// merge returns p overridden by all values set in o. Lists are appended instead of replaced.
+func (p Preset) merge(o Preset) Preset {
+	if o.Mir != nil {
+		p.Mir = o.Mir
+	}
+	if o.Threads != nil {
+		p.Threads = o.Threads
+	}
+	if o.Retries != nil {
+		p.Retries = o.Retries
+	}
+	if o.Wait != nil {
+		p.Wait = o.Wait
+	}
+	p.ExcludeFiles = slices.Concat(p.ExcludeFiles, o.ExcludeFiles)
+	p.ExcludeDirs = slices.Concat(p.ExcludeDirs, o.ExcludeDirs)
+	p.Passthrough = slices.Concat(p.Passthrough, o.Passthrough)
+	if o.DeleteTo != "" {
+		p.DeleteTo = o.DeleteTo
+	}
+	return p
 }
 
 func defaultConfig() Config {
 	return Config{
 		UseNerdFontArrow: false,
 		ShowProgress: true,
-		Theme: Theme{
-			ColorNeutral: "#626262",
-			ColorPrimary: "#5956E0",
-			ColorSecondary: "#ADBDFF",
-			ColorError: "#DA4167",
-			ColorProgress: [2]string{"#5956E0", "#EE6FF8"},
+		Theme: builtinThemes["default"],
+		// : the "sane defaults"
+		Defaults: Preset{
+			Retries: ptr(2),
+			Wait: ptr(1),
 		},
+		ProtectedPaths: []string{"/", "/home", "/etc", "~", "?:/", "?:/Users", "?:/Windows", "?:/Windows/System32"},
+		RobocopyLanguage: "auto",
+		RobocopyEncoding: "auto",
+	}
+}
+
+// configSources maps every (lowercased, dotted) key set by a config layer to that layer's source,
+// i.e. a file path or an environment variable. Keys not present are at their default value.
+var configSources = map[string]string{}
+
+// ConfigFlags select which config files are loaded. Shared by the main command and `rbcp config`.
+type ConfigFlags struct {
+	ConfigPath string `arg:"--config" placeholder:"PATH" help:"Load only this config file instead of the system, user and project ones."`
+	NoConfig   bool   `arg:"--no-config" help:"Don't load any config file (RBCP_* environment overrides still apply)."`
+}
+
+// configLayer is a config file, see configLayers
+type configLayer struct {
+	Name string
+	Path string
+}
+
+// envPrefix is the prefix of environment variables overriding config keys, e.g. RBCP_THEME_COLORPRIMARY
+const envPrefix = "RBCP_"
+
+// systemConfigPath returns the path of the system-wide config file, which may not exist
+func systemConfigPath() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "rbcp", "rbcp.toml")
 	}
+	return "/etc/rbcp/rbcp.toml"
 }
 
-func GetConfig() Config {
-	// TODO: config file for preferences?
+// userConfigPath returns the path of the user config file, which may not exist
+func userConfigPath() string {
+	if envXDG := os.Getenv("XDG_CONFIG_HOME"); envXDG != "" {
+		return envXDG + "/rbcp.toml"
+	}
 	// All because this does not give $HOME/.config on windows whereas most devs do have it set to ~
 	configDir, _ := os.UserConfigDir()
 	if envHome := os.Getenv("HOME"); envHome != "" {
 		configDir = envHome + "/.config"
 	}
-	conf := defaultConfig()
-	// logger.Debugf("Default config is %v", conf) 
-	_, err := toml.DecodeFile(configDir + "/rbcp.toml", &conf)
+	return configDir + "/rbcp.toml"
+}
+
+// projectConfigPath returns the nearest .rbcp.toml walking up from the current directory, or "" if there is none
+func projectConfigPath() string {
+	dir, err := os.Getwd()
 	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ".rbcp.toml")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// configLayers returns the config files to load, in increasing order of precedence:
+// system, user and project (or only the one passed with --config, or none with --no-config).
+// Files that don't exist are included and skipped when loading.
+func configLayers(flags ConfigFlags) []configLayer {
+	switch {
+	case flags.NoConfig:
+		return nil
+	case flags.ConfigPath != "":
+		return []configLayer{{"--config", flags.ConfigPath}}
+	}
+	layers := []configLayer{
+		{"system", systemConfigPath()},
+		{"user", userConfigPath()},
+	}
+	if path := projectConfigPath(); path != "" {
+		layers = append(layers, configLayer{"project", path})
+	}
+	return layers
+}
+
+// GetConfig builds the config from the defaults, the config files (see configLayers) and the RBCP_* environment
+// overrides, each layer overriding the keys set by the ones before it.
+func GetConfig(flags ConfigFlags) Config {
+	configSources = map[string]string{}
+	merged := map[string]any{}
+
+	for _, layer := range configLayers(flags) {
+		// : decode once into the struct to catch wrong types (with line numbers) before merging
+		check := defaultConfig()
+		_, err := toml.DecodeFile(layer.Path, &check)
 		if errors.Is(err, fs.ErrNotExist) {
-			// f, err := os.Create(configDir + "/rbcp.toml")
-			// if err != nil {
-			// 	logger.Errorf("Could not create config file, continuing with defaults.")
-			// }
-		} else {
-			logger.Errorf("could not decode config file: %v", err)
+			if layer.Name == "--config" {
+				logger.Errorf("config file %v does not exist, continuing without it.", layer.Path)
+			}
+			continue
+		}
+		var raw map[string]any
+		if err == nil {
+			_, err = toml.DecodeFile(layer.Path, &raw)
+		}
+		if err != nil {
+			logger.Errorf("could not decode %v config file %v: %v\nRun `rbcp config validate` for details, skipping it.", layer.Name, layer.Path, err)
+			continue
 		}
+		logger.Debugf("Loaded %v config file %v", layer.Name, layer.Path)
+		mergeConfig(merged, raw, "", layer.Path)
+	}
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		raw, err := envOverride(name, value)
+		if errors.Is(err, errNoEnvKey) {
+			// : other tools can use the prefix too, rbcp config validate still reports them
+			logger.Debugf("ignoring environment variable %v: %v", name, err)
+			continue
+		} else if err != nil {
+			logger.Errorf("ignoring environment override %v: %v", name, err)
+			continue
+		}
+		mergeConfig(merged, raw, "", "$"+name)
+	}
+
+	conf := defaultConfig()
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(merged)
+	if err == nil {
+		_, err = toml.Decode(buf.String(), &conf)
+	}
+	if err != nil {
+		logger.Errorf("could not apply config: %v\nContinuing with defaults.", err)
+		conf = defaultConfig()
 	}
 	logger.Infof("Decoded config is %+v", conf)
 	setThemeColors(conf.Theme)
 	return conf
 }
 
+// mergeConfig deep merges the toml table src into dst, recording source for every leaf value in configSources.
+// Keys are lowercased, which is fine as decoding into Config is case-insensitive.
+func mergeConfig(dst, src map[string]any, prefix string, source string) {
+	for key, value := range src {
+		key = strings.ToLower(key)
+		full := key
+		if prefix != "" {
+			full = prefix + "." + key
+		}
+		if table, ok := value.(map[string]any); ok {
+			sub, ok := dst[key].(map[string]any)
+			if !ok {
+				sub = map[string]any{}
+				// : theme = "name" followed by a [theme] table in a later layer only overrides single colors of it
+				if name, isName := dst[key].(string); isName && key == "theme" {
+					sub["name"] = name
+					configSources[full+".name"] = configSources[full]
+				}
+				dst[key] = sub
+			}
+			mergeConfig(sub, table, full, source)
+			continue
+		}
+		dst[key] = value
+		configSources[full] = source
+	}
+}
+
+// errNoEnvKey is the error of envOverride for an RBCP_* variable that matches no config key
+var errNoEnvKey = errors.New("no config key matches")
+
+// envOverride converts an RBCP_* environment variable to a toml table with the key it overrides.
+// The value is parsed as a toml value (e.g. true, 4, ["a", "b"]) and taken as a plain string if that fails.
+func envOverride(name, value string) (map[string]any, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimPrefix(name, envPrefix)), "_")
+	key, ok := envKey(reflect.TypeFor[Config](), parts)
+	if !ok {
+		return nil, fmt.Errorf("%w %v", errNoEnvKey, name)
+	}
+
+	// : values like 12 could also be meant as strings (an ANSI color), so fall back to the raw string
+	candidates := []any{value}
+	var parsed map[string]any
+	if _, err := toml.Decode("v = "+value, &parsed); err == nil {
+		candidates = []any{parsed["v"], value}
+	}
+	var err error
+	for _, v := range candidates {
+		raw := map[string]any{key[len(key)-1]: v}
+		for i := len(key) - 2; i >= 0; i-- {
+			raw = map[string]any{key[i]: raw}
+		}
+		if err = checkConfig(raw); err == nil {
+			return raw, nil
+		}
+	}
+	return nil, err
+}
+
+// checkConfig reports whether the toml table raw can be decoded into a Config
+func checkConfig(raw map[string]any) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+		return err
+	}
+	check := defaultConfig()
+	if _, err := toml.Decode(buf.String(), &check); err != nil {
+		// : line numbers are meaningless here
+		return errors.New(reTomlErrPrefix.ReplaceAllString(err.Error(), ""))
+	}
+	return nil
+}
+
+var reTomlErrPrefix = regexp.MustCompile(`^toml: (line \d+ )?(\(last key "[^"]*"\): )?`)
+
+// envKey resolves the _-separated parts of an environment variable name to a config key, by matching them against
+// the (lowercased or toml tag) names of the fields of t. Parts are joined back when a field name itself contains _.
+func envKey(t reflect.Type, parts []string) ([]string, bool) {
+	if len(parts) == 0 {
+		return nil, true
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return envKey(t.Elem(), parts)
+	case reflect.Map:
+		rest, ok := envKey(t.Elem(), parts[1:])
+		return append([]string{parts[0]}, rest...), ok
+	case reflect.Struct:
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name := strings.ToLower(field.Name)
+			if tag, _, _ := strings.Cut(field.Tag.Get("toml"), ","); tag != "" {
+				name = tag
+			}
+			for n := 1; n <= len(parts); n++ {
+				if strings.Join(parts[:n], "_") != name {
+					continue
+				}
+				if rest, ok := envKey(field.Type, parts[n:]); ok {
+					return append([]string{name}, rest...), true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
 func setThemeColors(t Theme) {
-	helpStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color(t.ColorNeutral))
-	impStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color(t.ColorPrimary)).Bold(true)
-	pathStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color(t.ColorSecondary)).Italic(true)
-	errorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color(t.ColorError)).Bold(true)
-}
\ No newline at end of file
+	helpStyle  = lipgloss.NewStyle().Foreground(t.ColorNeutral.terminal())
+	impStyle   = lipgloss.NewStyle().Foreground(t.ColorPrimary.terminal()).Bold(true)
+	pathStyle  = lipgloss.NewStyle().Foreground(t.ColorSecondary.terminal()).Italic(true)
+	errorStyle = lipgloss.NewStyle().Foreground(t.ColorError.terminal()).Bold(true)
+}
+
+// effectivePreset merges [defaults] (unless --insane), the profile selected with --profile and the CLI flags, in that order
+func effectivePreset() Preset {
+	var preset Preset
+	if !args.Insane {
+		preset = config.Defaults
+	}
+	if args.Profile != "" {
+		// : keys (and hence profile names) are lowercased when merging config layers
+		profile, ok := config.Profiles[strings.ToLower(args.Profile)]
+		if !ok {
+			available := make([]string, 0, len(config.Profiles))
+			for name := range config.Profiles {
+				available = append(available, name)
+			}
+			sort.Strings(available)
+			logger.Fatalf("Profile %v not found in config (available: %v)", pathStyle.Render(args.Profile), strings.Join(available, ", "))
+		}
+		preset = preset.merge(profile)
+	}
+	cli := Preset{
+		Threads: args.Threads,
+		Retries: args.Retries,
+		Wait: args.Wait,
+		ExcludeFiles: args.ExcludeFiles,
+		ExcludeDirs: args.ExcludeDirs,
+		Passthrough: args.OtherArgs,
+		DeleteTo: args.DeleteTo,
+	}
+	if args.Mir {
+		cli.Mir = ptr(true)
+	}
+	return preset.merge(cli)
+}
+
+// printConfig prints the loaded config along with the effective (merged) copy options as TOML
+func printConfig() {
+	out := struct {
+		Config
+		Effective Preset
+	}{config, opts}
+	if err := toml.NewEncoder(os.Stdout).Encode(out); err != nil {
+		logger.Fatalf("could not encode config: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/x/term"
+
+	"rbcp/robocopy"
+)
+
+// # Deletion safeguards
+// A run that deletes files (/MIR, /PURGE, /MOVE) first shows what its list pass would delete, and only starts once
+// that is confirmed interactively or with --yes, and stays within --max-delete.
+
+// deletionSample is how many of the deleted files are shown
+const deletionSample = 10
+
+// confirmDeletions previews what a job deletes according to its list pass, and reports whether it may run
+func confirmDeletions(job robocopy.Job, listing robocopy.Listing, yes bool, maxDelete *int) bool {
+	purges, moves := job.Options.Purges(), job.Options.Moves()
+	if !purges && !moves {
+		return true
+	}
+
+	var extras robocopy.FileStats
+	if purges {
+		for _, e := range listing.Extras {
+			if e.Action == "*EXTRA Dir" {
+				extras.Dirs++
+			} else {
+				extras.Files++
+				extras.Bytes += e.Size
+			}
+		}
+	}
+	if extras.Files+extras.Dirs == 0 && (!moves || len(listing.Files) == 0) {
+		return true
+	}
+
+	fmt.Println()
+	if extras.Files+extras.Dirs > 0 {
+		dest, _ := job.AbsDest()
+		fmt.Printf("This job %v %s from %v that are not in the source:\n", errorStyle.Render("deletes"),
+			impStyle.Render(fmt.Sprintf("%d files, %d dirs (%v)", extras.Files, extras.Dirs, formatByteValue(extras.Bytes))),
+			pathStyle.Render(job.Dest))
+		for _, e := range listing.Extras[:min(len(listing.Extras), deletionSample)] {
+			rel, _ := robocopy.RelPath(dest, e.Path)
+			if e.Action == "*EXTRA Dir" {
+				fmt.Println("  - " + rel)
+			} else {
+				fmt.Println("  - " + rel + " " + helpStyle.Render(formatByteValue(e.Size)))
+			}
+		}
+		if len(listing.Extras) > deletionSample {
+			fmt.Println(helpStyle.Render(fmt.Sprintf("  ... and %d more, see them all with --list", len(listing.Extras)-deletionSample)))
+		}
+	}
+	if purges && opts.DeleteTo != "" && extras.Files+extras.Dirs > 0 {
+		fmt.Println(helpStyle.Render("They are moved to a quarantine directory in " + opts.DeleteTo + " first"))
+	}
+	if moves && len(listing.Files) > 0 {
+		fmt.Printf("This job %v %s: they are deleted from the source once copied\n", errorStyle.Render("moves"),
+			impStyle.Render(fmt.Sprintf("%d files (%v)", listing.Stats.Copied.Files, formatByteValue(listing.Stats.Copied.Bytes))))
+	}
+
+	if maxDelete != nil && extras.Files+extras.Dirs > *maxDelete {
+		logger.Errorf("%d files and directories would be deleted, more than --max-delete %d, aborting",
+			extras.Files+extras.Dirs, *maxDelete)
+		return false
+	}
+	if yes {
+		return true
+	}
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		logger.Errorf("Refusing to delete files without confirmation, pass --yes to run non-interactively")
+		return false
+	}
+	logger.Warnf("Continue and " + errorStyle.Render("delete") + " them? (y/n)")
+	if getUserInputYN() != "y" {
+		fmt.Println("Aborted, nothing was copied or deleted")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexflint/go-arg"
+
+	"rbcp/robocopy"
+)
+
+// # rbcp diff
+// diff classifies every file and directory of two trees with a list pass of robocopy (with /V, so unchanged files are
+// listed too), optionally comparing the contents of the files in both trees. Like diff, it exits with 0 if the trees
+// are identical, 1 if they differ and 2 on any error.
+
+type DiffCmd struct {
+	CommonFlags
+	Src    string `arg:"positional,required" placeholder:"SRC" help:"source directory"`
+	Dest   string `arg:"positional,required" placeholder:"DEST" help:"destination directory"`
+	Format string `arg:"--format" placeholder:"FORMAT" default:"text" help:"output format: text, json or csv"`
+	Hash   string `arg:"--hash" placeholder:"ALGO" help:"also compare the contents of files in both trees: sha256 (for a bare --hash), blake3 or xxh3"`
+}
+
+func (DiffCmd) Description() string {
+	return "Compare two directory trees, as robocopy sees them.\n"
+}
+
+var diffFormats = []string{"text", "json", "csv"}
+
+// diffClasses maps the classes robocopy gives files and directories to the classes of diff
+var diffClasses = map[string]string{
+	"New File":    "new",
+	"New Dir":     "new",
+	"Newer":       "newer",
+	"Older":       "older",
+	"Changed":     "changed",
+	"Modified":    "changed",
+	"Tweaked":     "changed",
+	"File":        "changed",
+	"same":        "same",
+	"*EXTRA File": "extra",
+	"*EXTRA Dir":  "extra",
+}
+
+var diffClassOrder = []string{"new", "newer", "older", "changed", "same", "extra"}
+
+// DiffEntry is a file or directory that is only in one of the trees, or in both
+type DiffEntry struct {
+	// Class is one of new (only in SRC), newer, older, changed, same or extra (only in DEST)
+	Class string `json:"class"`
+	// Path relative to the trees, with forward slashes
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+	// Reason the contents differ, or could not be compared, with --hash
+	Reason string `json:"reason,omitempty"`
+}
+
+// diffExit exits like diff: 2 for errors, including invalid arguments
+func diffExit(code int) {
+	if code != 0 {
+		code = 2
+	}
+	os.Exit(code)
+}
+
+func runDiffCmd(argv []string) {
+	var cmd DiffCmd
+	parser, err := arg.NewParser(arg.Config{Program: ProgramName + " diff", Exit: diffExit}, &cmd)
+	if err != nil {
+		logger.Fatalf("could not build parser for diff: %v", err)
+	}
+	parser.MustParse(withDefaultHash(argv, "--hash"))
+	args.CommonFlags = cmd.CommonFlags
+	initWidth := setup()
+	if !slices.Contains(diffFormats, cmd.Format) {
+		parser.Fail("--format must be one of " + strings.Join(diffFormats, ", "))
+	}
+	if _, ok := hashAlgorithms[cmd.Hash]; cmd.Hash != "" && !ok {
+		parser.Fail("unknown hash algorithm " + cmd.Hash + ", use sha256, blake3 or xxh3")
+	}
+	for _, dir := range []string{cmd.Src, cmd.Dest} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			logger.Errorf("%v is not a directory", dir)
+			os.Exit(2)
+		}
+	}
+
+	// : /E to compare subdirectories, /V to list unchanged files as "same"
+	diffJob := robocopy.Job{Sources: []string{cmd.Src}, Dest: cmd.Dest, Options: robocopy.Options{Extra: []string{"/E", "/V"}},
+		Language: config.RobocopyLanguage, Encoding: config.RobocopyEncoding}
+	ctx, cancel := jobContext()
+	defer cancel()
+	listing, err := diffJob.List(ctx)
+	if err != nil || listing.Stats.ExitCode >= 8 || len(listing.Stats.Errors) > 0 {
+		if err != nil {
+			logger.Errorf("Error running the list pass: %v", err)
+		}
+		for _, e := range listing.Stats.Errors {
+			logger.Errorf("%v %v: %v", e.Action, e.Path, e.Message)
+		}
+		logger.Errorf("Could not compare the trees, robocopy exited with code %d", listing.Stats.ExitCode)
+		os.Exit(2)
+	}
+	entries, err := diffEntries(diffJob, listing)
+	if err != nil {
+		logger.Errorf("Could not compare the trees: %v", err)
+		os.Exit(2)
+	}
+
+	failed := false
+	if cmd.Hash != "" {
+		failed = !compareContents(diffJob, entries, cmd.Hash, initWidth, cmd.Format != "text")
+	}
+	slices.SortStableFunc(entries, func(a, b DiffEntry) int { return strings.Compare(a.Path, b.Path) })
+	summary := make(map[string]planTotal)
+	identical := true
+	for _, e := range entries {
+		total := summary[e.Class]
+		if e.Dir {
+			total.Dirs++
+		} else {
+			total.Files++
+		}
+		total.Bytes += e.Size
+		summary[e.Class] = total
+		if e.Class != "same" {
+			identical = false
+		}
+	}
+
+	switch cmd.Format {
+	case "json":
+		data, err := json.MarshalIndent(struct {
+			Summary map[string]planTotal `json:"summary"`
+			Entries []DiffEntry          `json:"entries"`
+		}{summary, entries}, "", "  ")
+		if err != nil {
+			logger.Errorf("could not encode the diff: %v", err)
+			os.Exit(2)
+		}
+		os.Stdout.Write(append(data, '\n'))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"class", "path", "size", "dir", "reason"})
+		for _, e := range entries {
+			w.Write([]string{e.Class, e.Path, strconv.FormatInt(e.Size, 10), strconv.FormatBool(e.Dir), e.Reason})
+		}
+		w.Flush()
+	default:
+		displayDiff(cmd.Src, cmd.Dest, entries, summary, identical)
+	}
+
+	switch {
+	case failed:
+		os.Exit(2)
+	case !identical:
+		os.Exit(1)
+	}
+}
+
+// diffEntries classifies the entries of the list pass of a diff job
+func diffEntries(job robocopy.Job, listing robocopy.Listing) ([]DiffEntry, error) {
+	root, err := job.AbsRoot()
+	if err != nil {
+		return nil, err
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DiffEntry, 0, len(listing.Dirs)+len(listing.Files)+len(listing.Same)+len(listing.Extras))
+	add := func(base string, e robocopy.FileEvent) {
+		class, ok := diffClasses[e.Action]
+		if !ok {
+			class = "changed"
+		}
+		rel, _ := robocopy.RelPath(base, e.Path)
+		dir := e.Action == "New Dir" || e.Action == "*EXTRA Dir"
+		if dir {
+			rel = strings.TrimSuffix(rel, "/")
+		}
+		entries = append(entries, DiffEntry{Class: class, Path: rel, Size: e.Size, Dir: dir})
+	}
+	for _, events := range [][]robocopy.FileEvent{listing.Dirs, listing.Files, listing.Same} {
+		for _, e := range events {
+			add(root, e)
+		}
+	}
+	for _, e := range listing.Extras {
+		add(dest, e)
+	}
+	return entries, nil
+}
+
+// compareContents hashes the files in both trees with algorithm, reclassifying them as same if their contents are
+// identical and as changed if robocopy considered them the same but their contents differ. It reports whether every
+// file could be compared.
+func compareContents(job robocopy.Job, entries []DiffEntry, algorithm string, initWidth int, quiet bool) bool {
+	root, err := job.AbsRoot()
+	if err != nil {
+		logger.Errorf("Invalid source: %v", err)
+		return false
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		logger.Errorf("Invalid destination: %v", err)
+		return false
+	}
+
+	files := make([]string, 0)
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		if !e.Dir && e.Class != "new" && e.Class != "extra" {
+			files = append(files, e.Path)
+			sizes[e.Path] = e.Size
+		}
+	}
+	var mu sync.Mutex
+	unreadable := make(map[string]bool)
+	newHash := hashAlgorithms[algorithm]
+	ctx, cancel := jobContext()
+	defer cancel()
+	result := hashFiles(ctx, files, sizes, initWidth, quiet, func(rel string) string {
+		src, dst := filepath.Join(root, rel), filepath.Join(dest, rel)
+		fail := func(reason string) string {
+			mu.Lock()
+			unreadable[rel] = true
+			mu.Unlock()
+			return reason
+		}
+		// : no need to hash files of different sizes
+		if info, err := os.Stat(dst); err != nil {
+			return fail("cannot read the destination: " + err.Error())
+		} else if info.Size() != sizes[rel] {
+			return fmt.Sprintf("size differs (%v in SRC, %v in DEST)", formatByteValue(sizes[rel]),
+				formatByteValue(info.Size()))
+		}
+		srcSum, err := hashFile(src, newHash)
+		if err != nil {
+			return fail("cannot read the source: " + err.Error())
+		}
+		dstSum, err := hashFile(dst, newHash)
+		if err != nil {
+			return fail("cannot read the destination: " + err.Error())
+		}
+		if !bytes.Equal(srcSum, dstSum) {
+			return algorithm + " differs"
+		}
+		return ""
+	})
+
+	reasons := make(map[string]string, len(result.Mismatches))
+	for _, m := range result.Mismatches {
+		reasons[m.Path] = m.Reason
+	}
+	hashed := make(map[string]bool, len(files))
+	for _, rel := range files {
+		hashed[rel] = true
+	}
+	for i, e := range entries {
+		if e.Dir || !hashed[e.Path] {
+			continue
+		}
+		reason, mismatch := reasons[e.Path]
+		switch {
+		case unreadable[e.Path]:
+			entries[i].Reason = reason
+		case mismatch:
+			entries[i].Reason = reason
+			if e.Class == "same" {
+				entries[i].Class = "changed"
+			}
+		case result.Files == result.Total:
+			entries[i].Class = "same"
+		}
+	}
+	for rel, reason := range reasons {
+		if unreadable[rel] {
+			logger.Errorf("Could not compare %v: %v", rel, reason)
+		}
+	}
+	return len(unreadable) == 0 && result.Files == result.Total
+}
+
+// displayDiff prints the entries that differ as a tree, with the reasons their contents differ, and a summary
+func displayDiff(src, dest string, entries []DiffEntry, summary map[string]planTotal, identical bool) {
+	fmt.Println("Comparing " + pathStyle.Render(src) + " with " + pathStyle.Render(dest))
+	if identical {
+		total := summary["same"]
+		fmt.Println("The trees are identical: " + impStyle.Render(strconv.Itoa(total.Files)+" files") + " " +
+			helpStyle.Render(formatByteValue(total.Bytes)))
+		return
+	}
+
+	actions := make([]PlanAction, 0)
+	for _, e := range entries {
+		if e.Class != "same" {
+			actions = append(actions, PlanAction{Action: e.Class, Path: e.Path, Size: e.Size, Dir: e.Dir})
+		}
+	}
+	fmt.Println(listTree(dest, actions, false))
+	for _, e := range entries {
+		if e.Reason != "" {
+			fmt.Println("  " + errorStyle.Render("✗") + " " + e.Path + ": " + e.Reason)
+		}
+	}
+	for _, class := range diffClassOrder {
+		total, ok := summary[class]
+		if !ok {
+			continue
+		}
+		counts := strconv.Itoa(total.Files) + " files"
+		if total.Dirs > 0 {
+			counts += ", " + strconv.Itoa(total.Dirs) + " dirs"
+		}
+		fmt.Println(fixedWidth.Render(class) + " " + impStyle.Render(counts) + " " + helpStyle.Render(formatByteValue(total.Bytes)))
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+// diskFree is not supported on this platform, the free space check is skipped
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskFree returns the space available to the user on the volume of dir
+func diskFree(dir string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+	return free, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"rbcp/robocopy"
+)
+
+// # Path guardrails
+// parseArgs and rbcp apply refuse jobs that mirror or move to (or move from) a protected path, copy the destination
+// into itself or mirror over their own source, unless --i-know-what-im-doing is passed.
+
+// guardJob exits if the paths of job are unsafe (see checkJobPaths), or only warns with --i-know-what-im-doing
+func guardJob(job robocopy.Job) {
+	problems := checkJobPaths(job, config.ProtectedPaths)
+	for _, problem := range problems {
+		if args.IKnowWhatImDoing {
+			logger.Warn(problem)
+		} else {
+			logger.Error(problem)
+		}
+	}
+	if len(problems) > 0 && !args.IKnowWhatImDoing {
+		logger.Errorf("Refusing to run this job, pass --i-know-what-im-doing to run it anyway")
+		exitRun(1)
+	}
+}
+
+// checkJobPaths describes every way the paths of a job are unsafe, nil if they are fine
+func checkJobPaths(job robocopy.Job, protected []string) []string {
+	root, err := job.AbsRoot()
+	if err != nil {
+		return nil
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		return nil
+	}
+	_, names, _ := job.Split()
+	copiesDir := len(names) == 0
+
+	var problems []string
+	if job.Options.Purges() {
+		if pattern, ok := isProtected(dest, protected); ok {
+			problems = append(problems, "DEST "+dest+" is a protected path ("+pattern+" in protected_paths), "+
+				"mirroring would delete everything in it that is not in the source")
+		}
+		if _, inside := robocopy.RelPath(dest, root); inside {
+			problems = append(problems, "SRC "+root+" is inside DEST "+dest+", mirroring would delete the source itself")
+		}
+	}
+	if job.Options.Moves() && !job.Options.Purges() {
+		if pattern, ok := isProtected(dest, protected); ok {
+			problems = append(problems, "DEST "+dest+" is a protected path ("+pattern+" in protected_paths), "+
+				"moving would put the source into it")
+		}
+	}
+	if job.Options.Moves() && copiesDir {
+		if pattern, ok := isProtected(root, protected); ok {
+			problems = append(problems, "SRC "+root+" is a protected path ("+pattern+" in protected_paths), "+
+				"moving would delete it")
+		}
+	}
+	if copiesDir && job.Options.Recursive() {
+		if _, inside := robocopy.RelPath(root, dest); inside {
+			problems = append(problems, "DEST "+dest+" is inside SRC "+root+", robocopy would copy the destination into itself")
+		}
+	}
+	return problems
+}
+
+// isProtected returns the pattern of protected matching the absolute path p, as returned by Job.AbsDest
+func isProtected(p string, protected []string) (string, bool) {
+	p = normalizeProtected(p)
+	for _, pattern := range protected {
+		if ok, _ := path.Match(normalizeProtected(pattern), p); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// normalizeProtected lowercases a path or pattern, with forward slashes, ~ expanded and no trailing slash except for
+// roots
+func normalizeProtected(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, `~\`) {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = home + p[1:]
+		}
+	}
+	p = strings.TrimSuffix(path.Clean(filepath.ToSlash(p)), "/")
+	if p == "" || strings.HasSuffix(p, ":") {
+		p += "/"
+	}
+	return strings.ToLower(p)
+}
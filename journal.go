@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"rbcp/robocopy"
+)
+
+// # Job journal
+// Every copy writes a journal to the state directory: the job, the files planned by the list pass and every file
+// started, done or failed. `rbcp resume` uses it to copy only what is left. The journal is removed once the job
+// succeeds.
+
+// journalHeader is the first line of a journal
+type journalHeader struct {
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	Job     robocopy.Job `json:"job"`
+}
+
+// journalEntry is any other line of a journal, with exactly one of Plan, Start, Done or Failed set.
+// Paths are relative to the source root, with forward slashes.
+type journalEntry struct {
+	Plan   string `json:"plan,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Start  string `json:"start,omitempty"`
+	Done   string `json:"done,omitempty"`
+	Failed string `json:"failed,omitempty"`
+}
+
+type Journal struct {
+	journalHeader
+	path string
+	file *os.File
+	// absolute root of the job, see robocopy.Job.AbsRoot
+	root string
+
+	// state replayed from the journal
+	planned  map[string]int64
+	order    []string
+	done     map[string]bool
+	failed   map[string]bool
+	inFlight string
+}
+
+// journalDir returns the directory journals are written to
+func journalDir() string {
+	return filepath.Join(stateDir(), "jobs")
+}
+
+// stateDir returns the directory rbcp keeps its state in
+func stateDir() string {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, ProgramName)
+		}
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, ProgramName)
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "state", ProgramName)
+}
+
+// newJournal creates the journal for a new job. The paths of the job are made absolute, so it can be resumed from
+// any directory.
+func newJournal(job robocopy.Job) (*Journal, error) {
+	root, err := job.AbsRoot()
+	if err != nil {
+		return nil, err
+	}
+	job.Sources = slices.Clone(job.Sources)
+	for i, src := range job.Sources {
+		if job.Sources[i], err = filepath.Abs(src); err != nil {
+			return nil, err
+		}
+	}
+	if job.Dest, err = filepath.Abs(job.Dest); err != nil {
+		return nil, err
+	}
+
+	dir := journalDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal{root: root, planned: make(map[string]int64), done: make(map[string]bool), failed: make(map[string]bool)}
+	j.Created = time.Now()
+	j.Job = job
+	// : IDs sort by creation time, with a suffix for jobs started in the same second
+	for i := 1; ; i++ {
+		j.ID = j.Created.Format("20060102-150405")
+		if i > 1 {
+			j.ID += fmt.Sprintf("-%d", i)
+		}
+		j.path = filepath.Join(dir, j.ID+".jsonl")
+		j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return j, j.write(j.journalHeader)
+}
+
+// loadJournal reads the journal of the job with the given ID, or of the most recent job if id is empty,
+// and opens it to record the resumed run
+func loadJournal(id string) (*Journal, error) {
+	path := filepath.Join(journalDir(), id+".jsonl")
+	if id == "" {
+		headers, err := listJournals()
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			return nil, errors.New("there is no job to resume")
+		}
+		path = filepath.Join(journalDir(), headers[len(headers)-1].ID+".jsonl")
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("there is no job %v to resume", id)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	j := &Journal{path: path, planned: make(map[string]int64), done: make(map[string]bool), failed: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &j.journalHeader); err != nil {
+				return nil, fmt.Errorf("%v: invalid header: %v", path, err)
+			}
+			continue
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// : the last line can be cut short if rbcp was killed while writing it
+			logger.Warnf("%v:%d: skipping invalid entry: %v", path, line, err)
+			continue
+		}
+		j.replay(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if j.root, err = j.Job.AbsRoot(); err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return j, err
+}
+
+// listJournals returns the headers of all journals, oldest first
+func listJournals() ([]journalHeader, error) {
+	matches, err := filepath.Glob(filepath.Join(journalDir(), "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]journalHeader, 0, len(matches))
+	for _, path := range matches {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var h journalHeader
+		err = json.NewDecoder(f).Decode(&h)
+		f.Close()
+		if err != nil {
+			logger.Warnf("skipping invalid journal %v: %v", path, err)
+			continue
+		}
+		headers = append(headers, h)
+	}
+	slices.SortFunc(headers, func(a, b journalHeader) int { return a.Created.Compare(b.Created) })
+	return headers, nil
+}
+
+// replay applies an entry to the state of the journal
+func (j *Journal) replay(e journalEntry) {
+	switch {
+	case e.Plan != "":
+		if _, ok := j.planned[e.Plan]; !ok {
+			j.order = append(j.order, e.Plan)
+		}
+		j.planned[e.Plan] = e.Size
+	case e.Start != "":
+		// : the outcome of a (re)started file is unknown until it is done or failed
+		j.inFlight = e.Start
+		delete(j.done, e.Start)
+		delete(j.failed, e.Start)
+	case e.Done != "":
+		j.done[e.Done] = true
+		delete(j.failed, e.Done)
+	case e.Failed != "":
+		j.failed[e.Failed] = true
+		delete(j.done, e.Failed)
+	}
+	if j.inFlight != "" && (j.done[j.inFlight] || j.failed[j.inFlight]) {
+		j.inFlight = ""
+	}
+}
+
+// write appends a line to the journal. Every line is written at once, so a journal stays readable if rbcp is killed.
+func (j *Journal) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	return err
+}
+
+// record writes an entry and applies it to the state, logging (only) if it cannot be written
+func (j *Journal) record(e journalEntry) {
+	j.replay(e)
+	if err := j.write(e); err != nil {
+		logger.Warnf("could not write to the journal %v: %v", j.path, err)
+	}
+}
+
+// rel returns the path of a file reported by robocopy relative to the source root
+func (j *Journal) rel(path string) string {
+	if rel, ok := robocopy.RelPath(j.root, path); ok {
+		return rel
+	}
+	return filepath.ToSlash(path)
+}
+
+// plan records the files found by the list pass, in a single write
+func (j *Journal) plan(files []robocopy.FileEvent) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, f := range files {
+		e := journalEntry{Plan: j.rel(f.Path), Size: f.Size}
+		j.replay(e)
+		enc.Encode(e)
+	}
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		logger.Warnf("could not write to the journal %v: %v", j.path, err)
+	}
+}
+
+// progress returns the number and size of the planned files already copied
+func (j *Journal) progress() (files int, bytesDone int64) {
+	for path, size := range j.planned {
+		if j.done[path] {
+			files++
+			bytesDone += size
+		}
+	}
+	return files, bytesDone
+}
+
+// total returns the number and size of all planned files
+func (j *Journal) total() (files int, bytesTotal int64) {
+	for _, size := range j.planned {
+		bytesTotal += size
+	}
+	return len(j.planned), bytesTotal
+}
+
+// remaining returns the absolute paths of the planned files that are not done yet, and the one that was being copied
+// when the job stopped (if any, it is not part of files)
+func (j *Journal) remaining() (files []string, inFlight string) {
+	for _, path := range j.order {
+		switch {
+		case j.done[path]:
+		case path == j.inFlight:
+			inFlight = j.root + path
+		default:
+			files = append(files, j.root+path)
+		}
+	}
+	return files, inFlight
+}
+
+// started reports whether robocopy began to copy any planned file
+func (j *Journal) started() bool {
+	return j.inFlight != "" || len(j.done) > 0 || len(j.failed) > 0
+}
+
+func (j *Journal) close() {
+	j.file.Close()
+}
+
+// remove deletes the journal, once the job is complete
+func (j *Journal) remove() {
+	j.file.Close()
+	if err := os.Remove(j.path); err != nil {
+		logger.Warnf("could not remove the journal %v: %v", j.path, err)
+	}
+}
+
+// observer wraps obs to record started, done and failed files in the journal
+func (j *Journal) observer(obs robocopy.Observer) robocopy.Observer {
+	return &journalObserver{Observer: obs, j: j}
+}
+
+type journalObserver struct {
+	robocopy.Observer
+	j *Journal
+	// the file being copied, and whether robocopy reported an error for it
+	current string
+	failed  bool
+}
+
+// finish marks the current file as done, unless it failed
+func (o *journalObserver) finish() {
+	if o.current != "" && !o.failed {
+		o.j.record(journalEntry{Done: o.current})
+	}
+	o.current = ""
+}
+
+func (o *journalObserver) OnFile(e robocopy.FileEvent) {
+	o.finish()
+	o.current, o.failed = o.j.rel(e.Path), false
+	o.j.record(journalEntry{Start: o.current})
+	o.Observer.OnFile(e)
+}
+
+// OnProgress records that robocopy retries the current file after an error, see robocopy.Stats.FailedPaths
+func (o *journalObserver) OnProgress(percent float32) {
+	if o.failed {
+		o.failed = false
+		o.j.record(journalEntry{Start: o.current})
+	}
+	o.Observer.OnProgress(percent)
+}
+
+func (o *journalObserver) OnError(e robocopy.ErrorEvent) {
+	if e.Path != "" && !strings.HasSuffix(e.Path, `\`) && !strings.HasSuffix(e.Path, "/") {
+		rel := o.j.rel(e.Path)
+		if rel == o.current {
+			o.failed = true
+		}
+		o.j.record(journalEntry{Failed: rel})
+	}
+	o.Observer.OnError(e)
+}
+
+func (o *journalObserver) OnSummary() {
+	o.finish()
+	o.Observer.OnSummary()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/charmbracelet/lipgloss/tree"
+)
+
+// # --list output
+// The list pass is rendered from its plan (see plan.go), as a tree, a table, json or csv.
+
+var listFormats = []string{"tree", "table", "json", "csv"}
+
+// actionStyle returns the style of an action: new files stand out, changed ones are secondary and extras are errors
+// if they get deleted
+func actionStyle(action string, purges bool) lipgloss.Style {
+	switch action {
+	case "new":
+		return impStyle
+	case "extra":
+		if purges {
+			return errorStyle
+		}
+		return helpStyle
+	default:
+		return pathStyle.Italic(false)
+	}
+}
+
+// displayListing prints the actions of a list pass in the given format
+func displayListing(plan Plan, format string) {
+	// : extras come last, the rest is sorted by path
+	actions := slices.Clone(plan.Actions)
+	slices.SortStableFunc(actions, func(a, b PlanAction) int {
+		if (a.Action == "extra") != (b.Action == "extra") {
+			if a.Action == "extra" {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(struct {
+			Summary map[string]planTotal `json:"summary"`
+			Actions []PlanAction         `json:"actions"`
+		}{plan.Summary, actions}, "", "  ")
+		if err != nil {
+			logger.Fatalf("could not encode the listing: %v", err)
+		}
+		os.Stdout.Write(append(data, '\n'))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"action", "path", "size", "dir"})
+		for _, a := range actions {
+			w.Write([]string{a.Action, a.Path, strconv.FormatInt(a.Size, 10), strconv.FormatBool(a.Dir)})
+		}
+		w.Flush()
+	case "table":
+		t := table.New().
+			Border(lipgloss.RoundedBorder()).
+			BorderStyle(helpStyle).
+			Headers("ACTION", "SIZE", "PATH").
+			StyleFunc(func(row, col int) lipgloss.Style {
+				style := lipgloss.NewStyle().Padding(0, 1)
+				if row == table.HeaderRow {
+					return style.Bold(true)
+				}
+				if col == 0 {
+					return style.Inherit(actionStyle(actions[row].Action, plan.Purges))
+				}
+				if col == 1 {
+					return style.Align(lipgloss.Right)
+				}
+				return style
+			})
+		for _, a := range actions {
+			size := formatByteValue(a.Size)
+			if a.Dir {
+				size = "dir"
+			}
+			t.Row(a.Action, size, a.Path)
+		}
+		fmt.Println(t)
+		displayPlanSummary(plan)
+	default:
+		fmt.Println(listTree(plan.Job.Dest, actions, plan.Purges))
+		displayPlanSummary(plan)
+	}
+}
+
+// listTree renders the actions as a directory tree, extras are merged into the source tree
+func listTree(dest string, actions []PlanAction, purges bool) *tree.Tree {
+	root := tree.Root(pathStyle.Render(dest)).EnumeratorStyle(helpStyle.PaddingRight(1))
+	// : directory nodes by their path, with a trailing slash
+	dirs := map[string]*tree.Tree{"": root}
+	var dirNode func(dir string) *tree.Tree
+	dirNode = func(dir string) *tree.Tree {
+		if node, ok := dirs[dir]; ok {
+			return node
+		}
+		parent, name := path.Split(strings.TrimSuffix(dir, "/"))
+		node := tree.Root(name + "/")
+		dirNode(parent).Child(node)
+		dirs[dir] = node
+		return node
+	}
+
+	for _, a := range actions {
+		tag := actionStyle(a.Action, purges).Render(a.Action)
+		if a.Dir {
+			dir := strings.TrimSuffix(a.Path, "/") + "/"
+			if _, ok := dirs[dir]; !ok {
+				parent, name := path.Split(strings.TrimSuffix(dir, "/"))
+				node := tree.Root(name + "/ " + tag)
+				dirNode(parent).Child(node)
+				dirs[dir] = node
+			}
+			continue
+		}
+		dir, name := path.Split(a.Path)
+		dirNode(dir).Child(name + " " + tag + " " + helpStyle.Render(formatByteValue(a.Size)))
+	}
+	return root
+}
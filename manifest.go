@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// # Checksum manifests
+// --manifest writes the sha256 of every copied file in the format of sha256sum, with paths relative to the
+// destination, and `rbcp check MANIFEST DIR` checks a tree against it, like `sha256sum -c`.
+
+type CheckCmd struct {
+	CommonFlags
+	Manifest string `arg:"positional,required" placeholder:"MANIFEST" help:"sha256sum manifest, e.g. written by --manifest"`
+	Dir      string `arg:"positional" placeholder:"DIR" default:"." help:"directory the paths of the manifest are relative to"`
+}
+
+func (CheckCmd) Description() string {
+	return "Check the files of DIR against a sha256sum manifest.\n"
+}
+
+// reManifestLine matches a line of sha256sum, in text or binary (*) mode. A leading \ means the path is escaped.
+var reManifestLine = regexp.MustCompile(`^(\\?)([0-9a-fA-F]{64}) [ *](.+)$`)
+
+var (
+	manifestEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	manifestUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// writeManifest writes the hashes of files (relative paths) to path in the format of sha256sum, sorted by path
+func writeManifest(path string, sums map[string][]byte) error {
+	var buf bytes.Buffer
+	paths := make([]string, 0, len(sums))
+	for rel := range sums {
+		paths = append(paths, rel)
+	}
+	slices.Sort(paths)
+	for _, rel := range paths {
+		// : like sha256sum, escape backslashes and newlines and mark the line with a leading backslash
+		name, prefix := rel, ""
+		if strings.ContainsAny(rel, "\\\n") {
+			name, prefix = manifestEscaper.Replace(rel), `\`
+		}
+		fmt.Fprintf(&buf, "%s%x  %s\n", prefix, sums[rel], name)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// readManifest reads a sha256sum manifest into its paths, in order, and their hashes
+func readManifest(path string) ([]string, map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	paths := make([]string, 0)
+	sums := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		match := reManifestLine.FindStringSubmatch(text)
+		if match == nil {
+			return nil, nil, fmt.Errorf("%v:%d: not a sha256 line", path, line)
+		}
+		rel := match[3]
+		if match[1] != "" {
+			rel = manifestUnescaper.Replace(rel)
+		}
+		sum, _ := hex.DecodeString(match[2])
+		if _, ok := sums[rel]; !ok {
+			paths = append(paths, rel)
+		}
+		sums[rel] = sum
+	}
+	return paths, sums, scanner.Err()
+}
+
+func runCheckCmd(argv []string) {
+	var cmd CheckCmd
+	parseSubcommand("check", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	initWidth := setup()
+
+	paths, sums, err := readManifest(cmd.Manifest)
+	if err != nil {
+		logger.Fatalf("Cannot read the manifest: %v", err)
+	}
+	fmt.Println("Checking " + pathStyle.Render(cmd.Dir) + " against " + pathStyle.Render(cmd.Manifest))
+
+	sizes := make(map[string]int64, len(paths))
+	for _, rel := range paths {
+		if info, err := os.Stat(filepath.Join(cmd.Dir, rel)); err == nil {
+			sizes[rel] = info.Size()
+		}
+	}
+	ctx, cancel := jobContext()
+	defer cancel()
+	result := hashFiles(ctx, paths, sizes, initWidth, false, func(rel string) string {
+		sum, err := hashFile(filepath.Join(cmd.Dir, rel), sha256.New)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return "missing"
+		case err != nil:
+			return "cannot read it: " + err.Error()
+		case !bytes.Equal(sum, sums[rel]):
+			return "sha256 differs"
+		}
+		return ""
+	})
+
+	line := "Checked " + impStyle.Render(fmt.Sprintf("%d files", result.Files))
+	if result.Files < result.Total {
+		line += fmt.Sprintf(" of %d", result.Total)
+	}
+	line += " (" + formatByteValue(result.Bytes) + ")"
+	if len(result.Mismatches) == 0 {
+		fmt.Println(line + ": all match")
+	} else {
+		fmt.Println(line + ": " + errorStyle.Render(fmt.Sprintf("%d mismatched", len(result.Mismatches))))
+		for _, m := range result.Mismatches {
+			fmt.Println("  " + errorStyle.Render("✗") + " " + m.Path + ": " + m.Reason)
+		}
+	}
+	if len(result.Mismatches) > 0 || result.Files < result.Total {
+		os.Exit(1)
+	}
+}
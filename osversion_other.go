@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// osVersion is not known on this platform
+func osVersion() string {
+	return ""
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"rbcp/robocopy"
+)
+
+// # rbcp plan / rbcp apply
+// plan records every action of the list pass in a plan file, apply runs the job of a plan after checking that a new
+// list pass still yields exactly the same actions.
+
+type PlanCmd struct {
+	Args
+	Output string `arg:"-o,--output" placeholder:"FILE" default:"plan.json" help:"file to write the plan to, - for stdout"`
+}
+
+func (PlanCmd) Description() string {
+	return "Record what copying SRC to DEST would do, for review and to run it later with rbcp apply.\n"
+}
+
+type ApplyCmd struct {
+	CommonFlags
+	Plan             string        `arg:"positional,required" placeholder:"PLAN" help:"plan file written by rbcp plan"`
+	PreserveExitCode bool          `arg:"-p,--preserve-exitcode" help:"always return the exit code given by robocopy"`
+	Timeout          time.Duration `placeholder:"DURATION" help:"stop the job after this long, e.g. 2h"`
+	StallTimeout     time.Duration `arg:"--stall-timeout" placeholder:"DURATION" help:"stop robocopy when it has shown no progress for this long"`
+	Yes              bool          `arg:"-y" help:"delete files with /MIR, /PURGE or /MOVE without asking for confirmation"`
+	MaxDelete        *int          `arg:"--max-delete" placeholder:"N" help:"abort if more than N files and directories would be deleted from the destination"`
+	DeleteTo         string        `arg:"--delete-to" placeholder:"DIR" help:"move the files the mirror would delete to a new quarantine directory in DIR first"`
+	SkipPreflight    bool          `arg:"--skip-preflight" help:"don't check free space, writability and path lengths of the destination before copying"`
+	IKnowWhatImDoing bool          `arg:"--i-know-what-im-doing" help:"run even if the job mirrors to a protected path or copies the destination into itself"`
+}
+
+// planVersion is bumped when the plan format changes
+const planVersion = 1
+
+type Plan struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Job     robocopy.Job `json:"job"`
+	// RobocopyArgs are the arguments robocopy is run with, for review
+	RobocopyArgs []string `json:"robocopy_args"`
+	// Purges is set if the extras are deleted
+	Purges  bool                 `json:"purges"`
+	Summary map[string]planTotal `json:"summary"`
+	Actions []PlanAction         `json:"actions"`
+}
+
+type planTotal struct {
+	Files int   `json:"files"`
+	Dirs  int   `json:"dirs,omitempty"`
+	Bytes int64 `json:"bytes"`
+}
+
+// PlanAction is what robocopy does with a single file or directory
+type PlanAction struct {
+	// Action is one of new, newer, older, changed, modified, tweaked, copy or extra
+	Action string `json:"action"`
+	// Path relative to the source (or destination for extras), with forward slashes
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+// planActions maps the classes robocopy gives files and directories to plan actions
+var planActions = map[string]string{
+	"New File":    "new",
+	"New Dir":     "new",
+	"Newer":       "newer",
+	"Older":       "older",
+	"Changed":     "changed",
+	"Modified":    "modified",
+	"Tweaked":     "tweaked",
+	"File":        "copy",
+	"*EXTRA File": "extra",
+	"*EXTRA Dir":  "extra",
+}
+
+var planActionOrder = []string{"new", "newer", "older", "changed", "modified", "tweaked", "copy", "extra"}
+
+// buildPlan builds the plan of a job from its list pass
+func buildPlan(job robocopy.Job, listing robocopy.Listing) (Plan, error) {
+	plan := Plan{Version: planVersion, Created: time.Now(), Job: job, Purges: job.Options.Purges(), Summary: make(map[string]planTotal)}
+	var err error
+	if plan.RobocopyArgs, err = job.RunArgs(); err != nil {
+		return plan, err
+	}
+	root, err := job.AbsRoot()
+	if err != nil {
+		return plan, err
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		return plan, err
+	}
+
+	add := func(base string, e robocopy.FileEvent) {
+		action, ok := planActions[e.Action]
+		if !ok {
+			action = e.Action
+		}
+		rel, _ := robocopy.RelPath(base, e.Path)
+		a := PlanAction{Action: action, Path: rel, Size: e.Size, Dir: e.Action == "New Dir" || e.Action == "*EXTRA Dir"}
+		plan.Actions = append(plan.Actions, a)
+		total := plan.Summary[action]
+		if a.Dir {
+			total.Dirs++
+		} else {
+			total.Files++
+		}
+		total.Bytes += a.Size
+		plan.Summary[action] = total
+	}
+	for _, e := range listing.Dirs {
+		add(root, e)
+	}
+	for _, e := range listing.Files {
+		add(root, e)
+	}
+	for _, e := range listing.Extras {
+		add(dest, e)
+	}
+	return plan, nil
+}
+
+// diffPlans describes every action that differs between two plans of the same job
+func diffPlans(old, new Plan) []string {
+	key := func(a PlanAction) string {
+		if a.Action == "extra" {
+			return "dest:" + a.Path
+		}
+		return "src:" + a.Path
+	}
+	describe := func(a PlanAction) string {
+		if a.Dir {
+			return a.Action + " " + a.Path + " (directory)"
+		}
+		return a.Action + " " + a.Path + " (" + formatByteValue(a.Size) + ")"
+	}
+
+	oldActions := make(map[string]PlanAction, len(old.Actions))
+	for _, a := range old.Actions {
+		oldActions[key(a)] = a
+	}
+	diffs := make([]string, 0)
+	for _, a := range new.Actions {
+		o, ok := oldActions[key(a)]
+		delete(oldActions, key(a))
+		switch {
+		case !ok:
+			diffs = append(diffs, errorStyle.Render("+ ")+describe(a))
+		case o != a:
+			diffs = append(diffs, errorStyle.Render("~ ")+describe(o)+" is now "+describe(a))
+		}
+	}
+	for _, a := range old.Actions {
+		if _, ok := oldActions[key(a)]; ok {
+			diffs = append(diffs, errorStyle.Render("- ")+describe(a))
+		}
+	}
+	return diffs
+}
+
+// displayPlanSummary prints the totals of every action of a plan
+func displayPlanSummary(plan Plan) {
+	if len(plan.Actions) == 0 {
+		fmt.Println("Nothing to do, the destination is up to date")
+		return
+	}
+	for _, action := range planActionOrder {
+		total, ok := plan.Summary[action]
+		if !ok {
+			continue
+		}
+		counts := strconv.Itoa(total.Files) + " files"
+		if total.Dirs > 0 {
+			counts += ", " + strconv.Itoa(total.Dirs) + " dirs"
+		}
+		line := fixedWidth.Render(action) + " " + impStyle.Render(counts) + " " + helpStyle.Render(formatByteValue(total.Bytes))
+		if action == "extra" {
+			if plan.Purges {
+				line += " " + errorStyle.Render("(deleted)")
+			} else {
+				line += " " + helpStyle.Render("(kept, not mirroring)")
+			}
+		}
+		fmt.Println(line)
+	}
+}
+
+func runPlanCmd(argv []string) {
+	var cmd PlanCmd
+	parser := parseSubcommand("plan", argv, &cmd)
+	args = cmd.Args
+	initWidth := setup()
+	if len(args.Paths) == 0 {
+		parser.Fail("SRC and DEST are required")
+	}
+	parseArgs()
+	printJobHeader(initWidth)
+
+	// : the plan holds absolute paths, so it can be applied from anywhere
+	root, err := job.AbsRoot()
+	if err != nil {
+		logger.Fatalf("Invalid sources: %v", err)
+	}
+	files := make([]string, 0)
+	if _, names, _ := job.Split(); len(names) > 0 {
+		for _, name := range names {
+			files = append(files, root+name)
+		}
+	} else {
+		files = append(files, root)
+	}
+	if job.Dest, err = job.AbsDest(); err != nil {
+		logger.Fatalf("Invalid destination: %v", err)
+	}
+	job.Sources = files
+
+	ctx, cancel := jobContext()
+	defer cancel()
+	listing, err := job.List(ctx)
+	if displayInvalidParameter(err) {
+		os.Exit(16)
+	} else if err != nil {
+		logger.Fatalf("Error running the list pass: %v", err)
+	}
+	plan, err := buildPlan(job, listing)
+	if err != nil {
+		logger.Fatalf("Could not build the plan: %v", err)
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		logger.Fatalf("could not encode the plan: %v", err)
+	}
+	if cmd.Output == "-" {
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+	if err := os.WriteFile(cmd.Output, append(data, '\n'), 0o644); err != nil {
+		logger.Fatalf("could not write the plan: %v", err)
+	}
+	displayPlanSummary(plan)
+	fmt.Println("Wrote the plan to " + pathStyle.Render(cmd.Output) + ", run it with: " + ProgramName + " apply " + cmd.Output)
+}
+
+func runApplyCmd(argv []string) {
+	var cmd ApplyCmd
+	parseSubcommand("apply", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	args.PreserveExitCode, args.Timeout, args.StallTimeout = cmd.PreserveExitCode, cmd.Timeout, cmd.StallTimeout
+	args.DeleteTo, args.IKnowWhatImDoing = cmd.DeleteTo, cmd.IKnowWhatImDoing
+	initWidth := setup()
+
+	data, err := os.ReadFile(cmd.Plan)
+	if err != nil {
+		logger.Fatalf("Cannot read the plan: %v", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		logger.Fatalf("Invalid plan %v: %v", cmd.Plan, err)
+	}
+	if plan.Version != planVersion {
+		logger.Fatalf("The plan was made by a different version of %v (plan version %d, expected %d), make a new one", ProgramName, plan.Version, planVersion)
+	}
+	job = plan.Job
+	job.StallTimeout, job.Language, job.Encoding = cmd.StallTimeout, config.RobocopyLanguage, config.RobocopyEncoding
+	printJobHeader(initWidth)
+	// : the plan may have been edited since, or be used on another machine
+	guardJob(job)
+
+	ctx, cancel := jobContext()
+	defer cancel()
+
+	// : the same list pass as the plan, which must yield exactly the same actions
+	listing, err := job.List(ctx)
+	if displayInvalidParameter(err) {
+		os.Exit(16)
+	} else if err != nil {
+		logger.Fatalf("Error running the list pass: %v", err)
+	}
+	current, err := buildPlan(job, listing)
+	if err != nil {
+		logger.Fatalf("Could not check the plan: %v", err)
+	}
+	if !slices.Equal(current.RobocopyArgs, plan.RobocopyArgs) {
+		logger.Fatalf("The plan was made with different robocopy arguments (%v), make a new one", plan.RobocopyArgs)
+	}
+	if diffs := diffPlans(plan, current); len(diffs) > 0 {
+		logger.Errorf("The source or destination changed since the plan was made (%v), refusing to apply it:",
+			plan.Created.Format(time.DateTime))
+		const maxDiffs = 20
+		for _, diff := range diffs[:min(len(diffs), maxDiffs)] {
+			fmt.Println("  " + diff)
+		}
+		if len(diffs) > maxDiffs {
+			fmt.Println(helpStyle.Render(fmt.Sprintf("  ... and %d more", len(diffs)-maxDiffs)))
+		}
+		os.Exit(1)
+	}
+	displayPlanSummary(plan)
+	if !cmd.SkipPreflight && !checkPreflight(job, listing) {
+		os.Exit(1)
+	}
+	if !confirmDeletions(job, listing, cmd.Yes, cmd.MaxDelete) {
+		os.Exit(1)
+	}
+	if opts.DeleteTo != "" {
+		quarantineExtras(listing)
+	}
+
+	if journal, err = newJournal(job); err != nil {
+		logger.Warnf("Could not create the job journal, this job will not be resumable: %v", err)
+	} else {
+		journal.plan(listing.Files)
+	}
+	stats, m, stoppedErr := copyWithTUI(ctx, cancel, []robocopy.Job{job},
+		newModel(listing.Stats.Copied.Files, listing.Stats.Copied.Bytes, initWidth))
+	finish(stats, nil, stoppedErr, m)
+}
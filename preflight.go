@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+
+	"rbcp/robocopy"
+)
+
+// # Preflight checks
+// After the list pass and before copying anything, check that the destination has room for everything to copy and is
+// writable, and warn about paths too long for most windows programs. Skipped with --skip-preflight.
+
+// maxPath is MAX_PATH on windows, including the terminating NUL
+const maxPath = 260
+
+// longPathSample is how many of the too long paths are shown
+const longPathSample = 5
+
+// preflight checks the destination of a job against its list pass, returning the problems that should stop it and
+// warnings that should not
+func preflight(job robocopy.Job, listing robocopy.Listing) (problems, warnings []string) {
+	dest, err := filepath.Abs(job.Dest)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	// : the destination is created by robocopy, check the closest directory that exists
+	existing := dest
+	for {
+		if info, err := os.Stat(existing); err == nil {
+			if !info.IsDir() {
+				return []string{"DEST " + existing + " is a file, not a directory"}, nil
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return []string{"DEST " + dest + " is on a volume that does not exist"}, nil
+		}
+		existing = parent
+	}
+
+	root, err := job.AbsRoot()
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	needed := spaceNeeded(job, root, dest, listing)
+	free, err := diskFree(existing)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+	case err != nil:
+		warnings = append(warnings, "Could not check the free space of "+existing+": "+err.Error())
+	case needed > 0 && uint64(needed) > free:
+		problems = append(problems, fmt.Sprintf("Not enough free space for DEST %v: %v needed, %v free (%v missing)",
+			dest, formatByteValue(needed), formatByteValue(int64(free)), formatByteValue(needed-int64(free))))
+	}
+
+	if f, err := os.CreateTemp(existing, ".rbcp-preflight-*"); err != nil {
+		problems = append(problems, "DEST "+existing+" is not writable: "+err.Error())
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	long := make([]string, 0)
+	for _, e := range listing.Files {
+		rel, _ := robocopy.RelPath(root, e.Path)
+		// : MAX_PATH counts UTF-16 code units
+		if p := filepath.Join(dest, rel); len(utf16.Encode([]rune(p))) >= maxPath {
+			long = append(long, p)
+		}
+	}
+	if len(long) > 0 {
+		warning := fmt.Sprintf("%d destination paths are longer than MAX_PATH (%d characters), many windows programs "+
+			"(e.g. Explorer) will not be able to open them:", len(long), maxPath-1)
+		for _, p := range long[:min(len(long), longPathSample)] {
+			warning += "\n  " + p
+		}
+		if len(long) > longPathSample {
+			warning += fmt.Sprintf("\n  ... and %d more", len(long)-longPathSample)
+		}
+		warnings = append(warnings, warning)
+	}
+	return problems, warnings
+}
+
+// spaceNeeded returns how much the copy adds to the destination volume: new files in full, overwritten files by how
+// much bigger they get, less the extras a purge deletes (unless they are moved to a quarantine with --delete-to)
+func spaceNeeded(job robocopy.Job, root, dest string, listing robocopy.Listing) int64 {
+	var needed int64
+	for _, e := range listing.Files {
+		needed += e.Size
+		if e.Action == "New File" {
+			continue
+		}
+		rel, _ := robocopy.RelPath(root, e.Path)
+		if info, err := os.Stat(filepath.Join(dest, rel)); err == nil && !info.IsDir() {
+			needed -= info.Size()
+		}
+	}
+	if job.Options.Purges() && opts.DeleteTo == "" {
+		for _, e := range listing.Extras {
+			needed -= e.Size
+		}
+	}
+	return needed
+}
+
+// checkPreflight runs the preflight checks of a job and reports whether it may run
+func checkPreflight(job robocopy.Job, listing robocopy.Listing) bool {
+	problems, warnings := preflight(job, listing)
+	for _, warning := range warnings {
+		logger.Warn(warning)
+	}
+	if len(problems) == 0 {
+		return true
+	}
+	for _, problem := range problems {
+		logger.Error(problem)
+	}
+	logger.Errorf("Preflight checks failed, nothing was copied. Pass --skip-preflight to copy anyway")
+	return false
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"rbcp/robocopy"
+)
+
+// # Quarantine
+// With --delete-to DIR (or DeleteTo in the config), the extras a mirror would purge are first moved to a new
+// timestamped directory DIR/ID, keeping their paths relative to the destination, and listed in the manifest DIR/ID.json.
+// `rbcp restore-quarantine DIR/ID` moves them back.
+
+type RestoreQuarantineCmd struct {
+	CommonFlags
+	Quarantine string `arg:"positional,required" placeholder:"DIR" help:"quarantine directory (DIR/ID given by --delete-to) or its manifest"`
+	Force      bool   `arg:"-f" help:"overwrite files that exist again in the destination"`
+}
+
+func (RestoreQuarantineCmd) Description() string {
+	return "Move the files a mirror quarantined with --delete-to back to its destination.\n"
+}
+
+type quarantineManifest struct {
+	Created time.Time `json:"created"`
+	// Dest is the absolute destination the files were moved from
+	Dest  string            `json:"dest"`
+	Files []quarantinedFile `json:"files"`
+}
+
+type quarantinedFile struct {
+	// Path relative to the destination (and the quarantine directory), with forward slashes
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+// quarantine moves the extras of a purging job to a new directory in deleteTo, and writes its manifest.
+// It returns the quarantine directory, which is empty if there was nothing to move.
+func quarantine(job robocopy.Job, listing robocopy.Listing, deleteTo string) (string, error) {
+	if !job.Options.Purges() || len(listing.Extras) == 0 {
+		return "", nil
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		return "", err
+	}
+	root, err := job.AbsRoot()
+	if err != nil {
+		return "", err
+	}
+	base, err := filepath.Abs(deleteTo)
+	if err != nil {
+		return "", err
+	}
+	// : the mirror would purge a quarantine in the destination, and copy one in the source
+	for _, dir := range []string{dest, root} {
+		if _, inside := robocopy.RelPath(dir, filepath.ToSlash(base)+"/"); inside {
+			return "", fmt.Errorf("the quarantine directory %v is inside %v", deleteTo, dir)
+		}
+	}
+
+	// : directories are moved whole, so everything listed inside them goes along
+	extras := slices.Clone(listing.Extras)
+	slices.SortStableFunc(extras, func(a, b robocopy.FileEvent) int {
+		if (a.Action == "*EXTRA Dir") != (b.Action == "*EXTRA Dir") {
+			if a.Action == "*EXTRA Dir" {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	files := make([]quarantinedFile, 0, len(extras))
+	for _, e := range extras {
+		rel, ok := robocopy.RelPath(dest, e.Path)
+		if !ok {
+			return "", fmt.Errorf("extra %v is not in the destination", e.Path)
+		}
+		rel = strings.TrimSuffix(rel, "/")
+		if !slices.ContainsFunc(files, func(f quarantinedFile) bool { return f.Dir && strings.HasPrefix(rel, f.Path+"/") }) {
+			files = append(files, quarantinedFile{Path: rel, Size: e.Size, Dir: e.Action == "*EXTRA Dir"})
+		}
+	}
+
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return "", err
+	}
+	// : same IDs as journals, with a suffix for mirrors started in the same second
+	created := time.Now()
+	var dir string
+	for i := 1; ; i++ {
+		dir = filepath.Join(base, created.Format("20060102-150405"))
+		if i > 1 {
+			dir += fmt.Sprintf("-%d", i)
+		}
+		err = os.Mkdir(dir, 0o755)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	manifest := quarantineManifest{Created: created, Dest: dest, Files: make([]quarantinedFile, 0, len(files))}
+	var moveErr error
+	for _, f := range files {
+		if moveErr = moveAll(filepath.Join(dest, f.Path), filepath.Join(dir, f.Path)); moveErr != nil {
+			moveErr = fmt.Errorf("could not quarantine %v: %w", f.Path, moveErr)
+			break
+		}
+		manifest.Files = append(manifest.Files, f)
+	}
+	// : written even if a move failed, so what was moved can be restored
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(dir+".json", append(data, '\n'), 0o644)
+	}
+	return dir, errors.Join(moveErr, err)
+}
+
+// quarantineExtras quarantines the extras of the job to opts.DeleteTo before it runs, exiting if that fails
+func quarantineExtras(listing robocopy.Listing) {
+	dir, err := quarantine(job, listing, opts.DeleteTo)
+	if err != nil {
+		if dir != "" {
+			logger.Errorf("Not mirroring, restore what was quarantined with: %v restore-quarantine %v", ProgramName, dir)
+		}
+		logger.Errorf("Could not quarantine the extra files: %v", err)
+		exitRun(1)
+	}
+	if dir != "" {
+		fmt.Println("Moved the extra files to " + pathStyle.Render(dir) + ", restore them with: " +
+			ProgramName + " restore-quarantine " + dir)
+	}
+}
+
+// moveAll moves a file or directory, copying it if it cannot be renamed, e.g. to another volume
+func moveAll(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.CopyFS(dst, os.DirFS(src))
+	} else {
+		err = copyFile(src, dst, info)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies a regular file, keeping its permissions and modification time
+func copyFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func runRestoreQuarantineCmd(argv []string) {
+	var cmd RestoreQuarantineCmd
+	parseSubcommand("restore-quarantine", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	setup()
+
+	dir := strings.TrimSuffix(filepath.Clean(cmd.Quarantine), ".json")
+	data, err := os.ReadFile(dir + ".json")
+	if err != nil {
+		logger.Fatalf("Cannot read the quarantine manifest: %v", err)
+	}
+	var manifest quarantineManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		logger.Fatalf("Invalid quarantine manifest %v: %v", dir+".json", err)
+	}
+
+	var restored robocopy.FileStats
+	skipped := 0
+	for _, f := range manifest.Files {
+		target := filepath.Join(manifest.Dest, f.Path)
+		// : restored by an earlier, interrupted run
+		if _, err := os.Lstat(filepath.Join(dir, f.Path)); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if _, err := os.Lstat(target); err == nil {
+			if !cmd.Force {
+				logger.Warnf("%v exists again in the destination, skipping it (pass --force to overwrite it)", f.Path)
+				skipped++
+				continue
+			}
+			if err := os.RemoveAll(target); err != nil {
+				logger.Fatalf("Could not overwrite %v: %v", target, err)
+			}
+		}
+		if err := moveAll(filepath.Join(dir, f.Path), target); err != nil {
+			logger.Fatalf("Could not restore %v: %v", f.Path, err)
+		}
+		if f.Dir {
+			restored.Dirs++
+		} else {
+			restored.Files++
+			restored.Bytes += f.Size
+		}
+	}
+
+	fmt.Printf("Restored %s to %v\n", impStyle.Render(fmt.Sprintf("%d files, %d dirs (%v)", restored.Files, restored.Dirs,
+		formatByteValue(restored.Bytes))), pathStyle.Render(manifest.Dest))
+	if skipped > 0 {
+		fmt.Println(helpStyle.Render(fmt.Sprintf("%d skipped, they are still in %v", skipped, dir)))
+		os.Exit(1)
+	}
+	// : only the (now empty) parent directories of the restored files are left
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warnf("could not remove the quarantine directory %v: %v", dir, err)
+	}
+	if err := os.Remove(dir + ".json"); err != nil {
+		logger.Warnf("could not remove the quarantine manifest: %v", err)
+	}
+}
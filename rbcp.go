@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"slices"
@@ -21,6 +20,8 @@ import (
 	"github.com/charmbracelet/log"
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
+
+	"rbcp/robocopy"
 )
 
 // # Version information
@@ -39,22 +40,53 @@ var (
 var (
 	p *tea.Program
  	config Config
+ 	// effective copy options, see effectivePreset
+ 	opts Preset
  	logger *log.Logger
  	args Args
- 	root string
- 	dest string
- 	files []string
+ 	job robocopy.Job
+ 	// journal of the running job, nil with --list or if it could not be created
+ 	journal *Journal
 )
 
 type Args struct {
-	Paths            []string `arg:"positional, required" placeholder:"SRC DEST"`
-	Mir              bool     `arg:"-m" help:"Convenience argument to specify /MIR to robocopy"`
-	List             bool     `arg:"-l" help:"Only list files that would be copied. Similar to a 'dry-run' "`
-	PreserveExitCode bool     `arg:"-p,--preserve-exitcode" help:"Always return the error code given by robocopy. By default, exit with code 0 on success and passthrough on copy failures."`
-	Insane           bool     `help:"Don't set sane defaults (currently sets #retries to 2 and timeout between them to 1 sec)."`
-	OtherArgs        []string `arg:"-[,--passthrough" help:"All other arguments to be passed directly to robocopy."`
+	Paths            []string      `arg:"positional" placeholder:"SRC DEST"`
+	Mir              bool          `arg:"-m" help:"Convenience argument to specify /MIR to robocopy"`
+	List             bool          `arg:"-l" help:"Only list files that would be copied. Similar to a 'dry-run' "`
+	ListFormat       string        `arg:"--list-format" placeholder:"FORMAT" default:"tree" help:"How --list shows the files: tree, table, json or csv."`
+	PreserveExitCode bool          `arg:"-p,--preserve-exitcode" help:"Always return the error code given by robocopy. By default, exit with code 0 on success and passthrough on copy failures."`
+	Insane           bool          `help:"Don't apply the [defaults] section of the config (by default sets #retries to 2 and timeout between them to 1 sec)."`
+	Profile          string        `placeholder:"NAME" help:"Apply the preset defined in the [profiles.NAME] section of the config."`
+	Threads          *int          `arg:"-t" placeholder:"N" help:"Number of threads to copy with (robocopy /MT:N)."`
+	Retries          *int          `arg:"-r" placeholder:"N" help:"Number of retries on failed copies (robocopy /R:N)."`
+	Wait             *int          `placeholder:"SECS" help:"Wait time between retries (robocopy /W:SECS)."`
+	ExcludeFiles     []string      `arg:"--xf,separate" placeholder:"PATTERN" help:"Exclude files matching the pattern (robocopy /XF). Can be repeated."`
+	ExcludeDirs      []string      `arg:"--xd,separate" placeholder:"PATTERN" help:"Exclude directories matching the pattern (robocopy /XD). Can be repeated."`
+	Timeout          time.Duration `placeholder:"DURATION" help:"Stop the whole job (list pass and copy) after this long, e.g. 2h."`
+	StallTimeout     time.Duration `arg:"--stall-timeout" placeholder:"DURATION" help:"Stop robocopy when it has shown no progress for this long, e.g. 10m."`
+	RetryJob         int           `arg:"--retry-job" placeholder:"N" help:"When robocopy fails (exit code >= 8), re-run only the failed files up to N times."`
+	RetryBackoff     time.Duration `arg:"--retry-backoff" placeholder:"DURATION" default:"30s" help:"Wait before the first --retry-job attempt, doubled for every further one."`
+	Yes              bool          `arg:"-y" help:"Delete files with /MIR, /PURGE or /MOVE without asking for confirmation."`
+	MaxDelete        *int          `arg:"--max-delete" placeholder:"N" help:"Abort if more than N files and directories would be deleted from the destination."`
+	DeleteTo         string        `arg:"--delete-to" placeholder:"DIR" help:"Move the files a mirror would delete to a new quarantine directory in DIR first, see rbcp restore-quarantine."`
+	IKnowWhatImDoing bool          `arg:"--i-know-what-im-doing" help:"Run even if the job mirrors to a protected path or copies the destination into itself."`
+	SkipPreflight    bool          `arg:"--skip-preflight" help:"Don't check free space, writability and path lengths of the destination before copying."`
+	Verify           string        `arg:"--verify" placeholder:"ALGO" help:"After copying, hash every copied file on both sides: sha256 (default for a bare --verify), blake3 or xxh3."`
+	VerifyAll        bool          `arg:"--verify-all" help:"Verify all files of the source, including the ones robocopy skipped. Implies --verify."`
+	Manifest         string        `arg:"--manifest" placeholder:"FILE" help:"After copying, write the sha256 of every copied file to FILE, in the format of sha256sum. See rbcp check."`
+	Record           string        `arg:"--record" placeholder:"FILE" help:"Save the raw output of robocopy with timestamps to FILE, to replay it with rbcp replay."`
+	Bugreport        bool          `arg:"--bugreport" help:"Capture debug logs and robocopy's output, and bundle them with the config and system info into a zip for a bug report."`
+	CommonFlags
+	PrintConfig bool     `arg:"--print-config" help:"Print the effective config (after merging defaults, profile and flags) and exit."`
+	OtherArgs   []string `arg:"-[,--passthrough" help:"All other arguments to be passed directly to robocopy."`
 	// !!! DISABLE IN PROD
-	Profile bool
+	Pprof bool
+}
+
+// CommonFlags are accepted by the main command and all subcommands
+type CommonFlags struct {
+	ConfigFlags
+	Color string `placeholder:"WHEN" default:"auto" help:"Colorize output: never, always or auto (honours NO_COLOR)."`
 }
 
 func (Args) Description() string {
@@ -63,7 +95,7 @@ func (Args) Description() string {
 
 func (Args) Version() string {
 	// impStyle will never be defined as GetConfig is never called in help/version text
-	impStyle = lipgloss.NewStyle().Foreground(lipgloss.Color(defaultConfig().Theme.ColorPrimary)).Bold(true)
+	impStyle = lipgloss.NewStyle().Foreground(defaultConfig().Theme.ColorPrimary.terminal()).Bold(true)
 	return impStyle.Render(ProgramName+" version "+Version) + "\n" +
 		"Commit: " + Commit + "\n" +
 		"Built: " + BuildDate
@@ -87,11 +119,29 @@ func setup() int {
 		}
 	}
 
-	config = GetConfig()
+	profile, err := resolveColorProfile(args.Color)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	colorProfile = profile
+	lipgloss.SetColorProfile(colorProfile)
+	logger.SetColorProfile(colorProfile)
+
+	// : before loading the config, whose problems are what bug reports are most often about
+	if args.Bugreport {
+		bugreport = startBugreport()
+	}
+	config = GetConfig(args.ConfigFlags)
+	opts = effectivePreset()
+	statusTemplate, summaryTemplate, err = parseTemplates(config)
+	if err != nil {
+		logger.Fatalf("invalid template in config: %v", err)
+	}
+	bugreport.saveConfig()
 
 	styles := log.DefaultStyles()
 	styles.Levels[log.ErrorLevel] = lipgloss.NewStyle().
-		Background(lipgloss.Color(config.Theme.ColorError)).Foreground(lipgloss.Color("#fff")).
+		Background(config.Theme.ColorError.terminal()).Foreground(lipgloss.Color("#fff")).
 		SetString("ERROR").Padding(0, 1).Bold(true)
 	styles.Levels[log.FatalLevel] = lipgloss.NewStyle().
 		Foreground(styles.Levels[log.FatalLevel].GetForeground()).
@@ -102,7 +152,7 @@ func setup() int {
 
 // # Parse arguments (break Paths into Src and Dest, perform expansions, build arguments for robocopy)
 func parseArgs() {
-	if args.Profile {
+	if args.Pprof {
 		os.MkdirAll("prof/", os.ModeDir)
 		runtime.SetBlockProfileRate(1)
 		t_now := time.Now().Format("2006-01-02 15.04.05")
@@ -120,13 +170,13 @@ func parseArgs() {
 		defer pprof.StopCPUProfile()
 	}
 
-	// stores the positions of files in args.Paths
-	files = make([]string, 0)
+	// source paths after expansion
+	sources := make([]string, 0)
 
 	if len(args.Paths) < 2 {
 		logger.Fatal("No destination specified")
 	}
-	dest = args.Paths[len(args.Paths)-1]
+	dest := args.Paths[len(args.Paths)-1]
 
 	// TODO: ensure args.mir does not proceed if files are given 
 	// : bash ./{a,b} brace expansion syntax
@@ -150,7 +200,7 @@ func parseArgs() {
 				switch choice {
 				case "n":
 					// do not expand
-					files = append(files, srcf)
+					sources = append(sources, srcf)
 					continue
 				case "y":
 				}
@@ -166,124 +216,256 @@ func parseArgs() {
 		}
 		logger.Infof("Expanded %v to %v", srcf, fields)
 		// ! check if a file exists with {} in its name and brace expansion would make it incorrect
-		files = append(files, fields...)
-	}
-	for i, srcf := range files {
-		// normalize paths; mvdan/sh has some weird behaviour i.e. 
-		// paths in globs are /-separated whereas paths in braces are \-separated 
-		srcf = filepath.ToSlash(srcf)
-		_, err := os.Stat(srcf)
-		if err == nil {
-			p, f := filepath.Split(srcf)
-			if p == "" {
-				logger.Debugf("Empty path, setting to ./")
-				p = "./"
-			}
-			if root == "" {
-				root = p
-			}
-			if root != p {
-				logger.Warnf("File passed not in root dir(%v): %v", root, srcf)
-			}
-			logger.Infof("Detected file %v and broke into %v and %v", srcf, p, f)
-			// args.Src[i] = p
-			// slices.Insert(args.OtherArgs, 0, f)
-			files[i] = f
-		} else {
-			logger.Errorf(errorStyle.Render("The file trying to be copied does not exist.\n%v"), err.Error())
-			os.Exit(1)
-		}
+		sources = append(sources, fields...)
+	}
+
+	job = robocopy.Job{Sources: sources, Dest: dest, Options: jobOptions(opts), StallTimeout: args.StallTimeout,
+		Language: config.RobocopyLanguage, Encoding: config.RobocopyEncoding}
+	root, files, err := job.Split()
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Errorf(errorStyle.Render("The file trying to be copied does not exist.\n%v"), err.Error())
+		exitRun(1)
+	} else if err != nil {
+		logger.Fatalf("Invalid sources: %v", err)
 	}
+	logger.Infof("Detected sources %v and broke into %v and %v", sources, root, files)
 
+	// : before any robocopy process starts, see guard.go
+	guardJob(job)
 }
 
-// # builds arguments for robocopy based on args. no side effects.
-func buildRobocopyArgs() []string {
-	out := []string{root, dest}
-	out = slices.Concat(out, files, args.OtherArgs)
-	// out = append(out, args.OtherArgs...)
-	if args.Mir {
-		out = append(out, "/MIR")
-	}
-	logger.Infof("Starting robocopy with arguments: %v", out)
-
-	if !args.List {
-		// Add our output formatting flags
-		notAllowed := []string{"/bytes", "/np", "/njh", "/njs", "/ndl", "/nfl", "/ns"}
-		slices.DeleteFunc(out, func(e string) bool {
-			return slices.Contains(notAllowed, strings.ToLower(e))
-		})
-		// let user log if wanted, but we need output to function so tee it
-		for _, e := range out {
-			e = strings.ToLower(e)
-			if strings.HasPrefix(e, "/log") || strings.HasPrefix(e, "/unilog") {
-				out = append(out, "/tee")
-			}
-		}
-		out = append(out, "/NJH", "/NDL", "/BYTES")
-		if !args.Insane {
-			out = append(out, "/R:2", "/W:1")
-		}
-	} else {
-		fmt.Println()
+// jobOptions converts the effective preset into robocopy options
+func jobOptions(preset Preset) robocopy.Options {
+	o := robocopy.Options{
+		Mirror:       preset.Mir != nil && *preset.Mir,
+		Retries:      preset.Retries,
+		Wait:         preset.Wait,
+		ExcludeFiles: preset.ExcludeFiles,
+		ExcludeDirs:  preset.ExcludeDirs,
+		Extra:        preset.Passthrough,
 	}
-	return out
+	if preset.Threads != nil {
+		o.Threads = *preset.Threads
+	}
+	return o
 }
 
 func main() {
 	logger = log.New(os.Stderr)
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
 
 	// : Argument parsing and applying effects
-	arg.MustParse(&args)
+	os.Args = withDefaultHash(os.Args, "--verify")
+	parser := arg.MustParse(&args)
 
 	initWidth := setup()
+	if args.PrintConfig {
+		printConfig()
+		return
+	}
+	if len(args.Paths) == 0 {
+		parser.Fail("SRC and DEST are required")
+	}
+	if !slices.Contains(listFormats, args.ListFormat) {
+		parser.Fail("--list-format must be one of " + strings.Join(listFormats, ", "))
+	}
+	if args.VerifyAll && args.Verify == "" {
+		args.Verify = defaultHashAlgorithm
+	}
+	if _, ok := hashAlgorithms[args.Verify]; args.Verify != "" && !ok {
+		parser.Fail("--verify must be one of sha256, blake3 or xxh3")
+	}
 	startTime := time.Now()
 	parseArgs()
 
-	arrow := pathStyle.Italic(false).Render(" --> ")
-	if config.UseNerdFontArrow {
-		arrow = pathStyle.Italic(false).Render(" ─── ")
+	// : machine readable listings print nothing but the data
+	if !args.List || args.ListFormat == "tree" || args.ListFormat == "table" {
+		printJobHeader(initWidth)
+	}
+
+	rbarglist, _ := job.RunArgs()
+	logger.Infof("Starting robocopy with arguments: %v", rbarglist)
+	if bugreport != nil {
+		bugreport.record()
+	}
+	if args.Record != "" {
+		recording, err := newRecording(args.Record, job)
+		if err != nil {
+			logger.Errorf("Cannot record robocopy's output: %v", err)
+			exitRun(1)
+		}
+		job.Recorder = recording
 	}
-	fmt.Println(lipgloss.PlaceHorizontal(initWidth, lipgloss.Center,
-		pathStyle.Render(root+"["+strings.Join(files, ",")+"]")+arrow+pathStyle.Render(args.Paths[len(args.Paths)-1])))
 
-	rbarglist := buildRobocopyArgs()
+	// : cancelled on force quit or after --timeout, which kills robocopy
+	ctx, cancel := jobContext()
+	defer cancel()
+
+	if !args.List && (args.Verify != "" || args.Manifest != "") {
+		var err error
+		if verifier, err = newVerifier(job, args.Verify, args.Manifest); err != nil {
+			logger.Errorf("Cannot verify this job: %v", err)
+			exitRun(1)
+		}
+	}
 
 	// : Dummy list-only run to get an overview of total
 	// if args.List is passed the program terminates inside this
-	totalFiles, totalBytes, err := getTotalCounts()
-	if err != nil {
-		logger.Fatalf("Error getting total counts: %v", err)
+	totalFiles, totalBytes, err := getTotalCounts(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Errorf("The list pass did not finish within --timeout %v", args.Timeout)
+		exitRun(16)
+	} else if displayInvalidParameter(err) {
+		exitRun(16)
+	} else if err != nil {
+		logger.Errorf("Error getting total counts: %v", err)
+		exitRun(1)
 	}
 	logger.Infof("Total to copy: %d files, %s\n", totalFiles, formatByteValue(totalBytes))
 
 	// : Init TUI and  start robocopy
-	m := model{
+	stats, m, stoppedErr := copyWithTUI(ctx, cancel, []robocopy.Job{job}, newModel(totalFiles, totalBytes, initWidth))
+	attempts := []robocopy.Stats{stats}
+
+	// : --retry-job, re-run only the files that failed
+	for attempt := 1; attempt <= args.RetryJob && stoppedErr == nil && stats.ExitCode >= 8; attempt++ {
+		last := attempts[len(attempts)-1]
+		failed := last.FailedPaths()
+		if len(failed) == 0 {
+			logger.Warn("robocopy failed without reporting which files, not retrying")
+			break
+		}
+		jobs, unmatched, err := job.Retry(failed)
+		if err != nil {
+			logger.Errorf("Could not build the retry: %v", err)
+			exitRun(1)
+		}
+		for _, path := range unmatched {
+			logger.Warnf("Cannot retry %v, it is not inside the source", path)
+		}
+		if len(jobs) == 0 {
+			break
+		}
+
+		backoff := args.RetryBackoff << (attempt - 1)
+		fmt.Printf("\n%v failed, retrying them in %v (attempt %d/%d)\n",
+			errorStyle.Render(strconv.Itoa(len(failed))+" paths"), backoff, attempt+1, args.RetryJob+1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			stoppedErr = &robocopy.StoppedError{Cause: context.Cause(ctx)}
+		}
+		if stoppedErr != nil {
+			break
+		}
+
+		retryFiles, retryBytes := 0, int64(0)
+		for _, j := range jobs {
+			files, bytesTotal, err := j.Count(ctx)
+			if err != nil {
+				logger.Warnf("Could not count the files to retry in %v: %v", j.Dest, err)
+			}
+			retryFiles += files
+			retryBytes += bytesTotal
+		}
+		var retryStats robocopy.Stats
+		retryStats, m, stoppedErr = copyWithTUI(ctx, cancel, jobs, newModel(retryFiles, retryBytes, initWidth))
+		attempts = append(attempts, retryStats)
+		stats.MergeRetry(retryStats)
+	}
+
+	if verifier != nil && stoppedErr == nil && !m.ForceQuit {
+		verifyCopy(ctx, &stats, initWidth)
+	}
+
+	timeTaken := time.Since(startTime)
+	logger.Infof("Whole program took %v", timeTaken)
+
+	// : Display summary
+	finish(stats, attempts, stoppedErr, m)
+}
+
+// jobContext returns the context robocopy runs in, cancelled on force quit or after --timeout
+func jobContext() (context.Context, context.CancelFunc) {
+	if args.Timeout > 0 {
+		return context.WithTimeout(context.Background(), args.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// finish displays the summary of a copy, completes its journal and exits with the appropriate code
+func finish(stats robocopy.Stats, attempts []robocopy.Stats, stopped *robocopy.StoppedError, m model) {
+	displaySummary(stats, attempts)
+	finishJournal(stats, stopped)
+	bugreport.finish()
+	if stopped != nil && !errors.Is(stopped, context.Canceled) {
+		displayStopped(stopped, m)
+		os.Exit(16)
+	}
+	if args.PreserveExitCode || stats.ExitCode >= 8 {
+		// Exit with the same code as robocopy
+		os.Exit(stats.ExitCode)
+	}
+}
+
+// printJobHeader prints the source and destination of the job, centered
+func printJobHeader(initWidth int) {
+	root, files, _ := job.Split()
+	fmt.Println(lipgloss.PlaceHorizontal(initWidth, lipgloss.Center,
+		pathStyle.Render(root+"["+strings.Join(files, ",")+"]")+headerArrow()+pathStyle.Render(job.Dest)))
+}
+
+// headerArrow returns the arrow between the source and the destination
+func headerArrow() string {
+	if config.UseNerdFontArrow {
+		return pathStyle.Italic(false).Render(" ─── ")
+	}
+	return pathStyle.Italic(false).Render(" --> ")
+}
+
+// newModel returns the TUI model for copying totalFiles files of totalBytes
+func newModel(totalFiles int, totalBytes int64, initWidth int) model {
+	return model{
 		progress: progress.New(
-			progress.WithGradient(config.Theme.ColorProgress[0], config.Theme.ColorProgress[1]),
+			progress.WithGradient(config.Theme.ColorProgress[0].resolve(), config.Theme.ColorProgress[1].resolve()),
+			progress.WithColorProfile(colorProfile),
 			// progress.WithSpringOptions(40, 1),
 		),
 		totalFiles: totalFiles,
 		totalBytes: totalBytes,
 		totalWidth: initWidth,
+		startTime: time.Now(),
 	}
+}
+
+// copyWithTUI runs the jobs one after the other with a single progress display, and returns their combined stats.
+// stopped is set if robocopy was killed before finishing (force quit, --timeout or --stall-timeout).
+func copyWithTUI(ctx context.Context, cancel context.CancelFunc, jobs []robocopy.Job, m model) (stats robocopy.Stats, _ model, stopped *robocopy.StoppedError) {
+	totalBytes := m.totalBytes
+	// : the root of the original job, as the retried or resumed jobs copy from its subdirectories
+	root, _ := job.AbsRoot()
+	m.threads = jobs[0].Options.ThreadCount()
 	p = tea.NewProgram(m)
 
-	var stats RobocopyStats
 	// this apparently makes a 0-memory channel
 	ended := make(chan struct{})
-	forceQuit := make(chan struct{})
 	go func() {
 		if totalBytes > 0 {
 			// returns after TUI exit
 			t, err := p.Run()
 			if err != nil {
-				logger.Fatal("error running program:", err)
-				os.Exit(1)
+				logger.Errorf("error running program: %v", err)
+				exitRun(1)
 			}
 			m = t.(model)
 			if m.ForceQuit {
-				forceQuit <- struct{}{}
+				// don't exit - can still display stats (if any)
+				cancel()
 			}
 		} else {
 			logger.Info("Nothing to copy, skipping progress bar")
@@ -295,11 +477,37 @@ func main() {
 	robocopyStart := time.Now()
 	var robocopyEnd time.Time
 	if totalBytes > 0 {
-		stats, err = runRobocopy(rbarglist, forceQuit)
-		if err != nil {
-			logger.Fatalf("Error: %v", err)
+		for i, j := range jobs {
+			var obs robocopy.Observer = newTeaObserver(p, root)
+			if i < len(jobs)-1 {
+				// : only the last job ends the TUI
+				obs = noSummaryObserver{obs}
+			}
+			if journal != nil {
+				obs = journal.observer(obs)
+			}
+			if verifier != nil {
+				obs = verifier.observer(obs)
+			}
+			jobStats, err := j.Run(ctx, obs)
+			logger.Infof("robocopy options: %v", strings.Join(jobStats.Header.Options, " "))
+			stats.Add(jobStats)
+			if errors.As(err, &stopped) {
+				// : the TUI only quits by itself on the summary (or on force quit)
+				p.Quit()
+				break
+			} else if err != nil && len(jobs) == 1 {
+				// : restore the terminal before exiting
+				p.Kill()
+				logger.Errorf("Error: %v", err)
+				exitRun(1)
+			} else if err != nil {
+				logger.Errorf("Error copying to %v: %v", j.Dest, err)
+				stats.ExitCode |= 16
+			}
 		}
-		// logger.Debugf("Killed")
+		logger.Debugf("%+v", stats)
+		// TODO: add OSC 9;4 (progress) support through https://github.com/charmbracelet/x/blob/main/ansi/progress.go (or bubbletea)
 		robocopyEnd = time.Now()
 		// p.Send(tea.Quit())
 		p.Wait()
@@ -309,113 +517,70 @@ func main() {
 	}
 
 	<-ended
-	// : Display summary
 	logger.Infof("Robocopy took %v", robocopyEnd.Sub(robocopyStart))
 	logger.Infof("Waited for %v", time.Since(robocopyEnd))
-	displaySummary(stats)
-
-	timeTaken := time.Since(startTime)
-	logger.Infof("Whole program took %v", timeTaken)
-
-	if args.PreserveExitCode || stats.ExitCode >= 8 {
-		// Exit with the same code as robocopy
-		os.Exit(stats.ExitCode)
-	}
+	return stats, m, stopped
 }
 
-func runRobocopy(args []string, forceQuit chan struct{}) (RobocopyStats, error) {
-	var stats RobocopyStats
-
-	// Start timing
-	startTime := time.Now()
-
-	// Run robocopy and capture output
-	ctx := context.Background()
-	cmd := exec.CommandContext(ctx, "robocopy", args...)
-	logger.Debugf("Starting command %v", cmd)
-	stdout, err := cmd.StdoutPipe()
+// getTotalCounts runs robocopy in list-only mode to get total files and bytes, and creates the journal of the job with
+// them. With --list, it prints the listing instead and exits.
+func getTotalCounts(ctx context.Context) (int, int64, error) {
+	listing, err := job.List(ctx)
 	if err != nil {
-		return stats, fmt.Errorf("failed to get stdout pipe: %v", err)
+		return 0, 0, err
 	}
-	// stderr, err := cmd.StderrPipe()
-	// if err != nil {
-	// 	return stats, fmt.Errorf("failed to get stderr pipe: %v", err)
-	// }
-
-	if err := cmd.Start(); err != nil {
-		return stats, fmt.Errorf("failed to start robocopy: %v", err)
+	if args.List {
+		plan, err := buildPlan(job, listing)
+		if err != nil {
+			return 0, 0, err
+		}
+		displayListing(plan, args.ListFormat)
+		exitRun(0)
 	}
-
-	ended := make(chan struct{})
-	var parsingTime time.Duration
-	go func() {
-		parsingStart := time.Now()
-		err = parseStreaming(stdout, &stats)
-		parsingTime = time.Since(parsingStart)
-		ended <- struct{}{}
-	}()
-
-	// no need to wait for both here - only one path can be true.
-	// also, don't return if forceQuit - can still display stats (if any)
-	select {
-	case <-forceQuit:
-		cmd.Cancel()
-	case <-ended:
-	}
-	cmd.Wait()
-	// TODO: add OSC 9;4 (progress) support through https://github.com/charmbracelet/x/blob/main/ansi/progress.go (or bubbletea)
-	// Calculate duration
-	endTime := time.Now()
-	stats.Duration = endTime.Sub(startTime)
-	stats.ExitCode = cmd.ProcessState.ExitCode()
-	logger.Infof("parsing took %v", parsingTime)
-	logger.Infof("Waited after cmd exit for parsing for %v", time.Since(endTime))
-
-	logger.Debugf("%+v", stats)
-	// Non-fatal error handling (robocopy uses exit codes for normal operations)
-	if err != nil && stats.ExitCode > 16 {
-		return stats, fmt.Errorf("robocopy failed with exit code %d: %v", stats.ExitCode, err)
-	}
-
-	return stats, nil
-}
-
-// getTotalCounts runs robocopy in list-only mode to get total files and bytes
-func getTotalCounts() (int, int64, error) {
-	// Clone args and add /L to make it "list only" mode
-	rbargs := buildRobocopyArgs()
-	listArgs := make([]string, len(rbargs))
-	copy(listArgs, rbargs)
-	if !args.List {
-		listArgs = append(listArgs, "/L", "/NFL", "/NDL", "/NP", "/NC", "/BYTES")
+	if !args.SkipPreflight && !checkPreflight(job, listing) {
+		exitRun(1)
 	}
-
-	cmd := exec.Command("robocopy", listArgs...)
-	output, err := cmd.CombinedOutput()
-	if args.List {
-		fmt.Print(string(output))
-		os.Exit(0)
+	if !confirmDeletions(job, listing, args.Yes, args.MaxDelete) {
+		exitRun(1)
 	}
-
-	var stats RobocopyStats
-	if err != nil && cmd.ProcessState.ExitCode() > 16 {
-		return 0, 0, fmt.Errorf("robocopy failed with exit code %d: %v", cmd.ProcessState.ExitCode(), err)
+	if opts.DeleteTo != "" {
+		quarantineExtras(listing)
 	}
-	// stderr, err := cmd.StderrPipe()
-	// if err != nil {
-	// 	return stats, fmt.Errorf("failed to get stderr pipe: %v", err)
-	// }
-
-	// if err := cmd.Start(); err != nil {
-	// 	return stats, fmt.Errorf("failed to start robocopy: %v", err)
-	// }
+	// : only now, so that jobs failing before the copy leave no journal to resume
+	if journal, err = newJournal(job); err != nil {
+		logger.Warnf("Could not create the job journal, this job will not be resumable: %v", err)
+	} else {
+		journal.plan(listing.Files)
+	}
+	return listing.Stats.Copied.Files, listing.Stats.Copied.Bytes, nil
+}
 
-	err = parseStreaming(bytes.NewReader(output), &stats)
+// exitRun exits a run that ends without finish, e.g. refused or failing: it removes the journal if nothing was copied
+// yet (or keeps it to resume the job) and writes the bug report of --bugreport
+func exitRun(code int) {
+	if journal != nil && journal.started() {
+		keepJournal()
+	} else if journal != nil {
+		journal.remove()
+	}
+	bugreport.finish()
+	os.Exit(code)
+}
 
-	if err != nil {
-		return 0, 0, err
+// finishJournal removes the journal of a successful job, or tells how to resume it
+func finishJournal(stats robocopy.Stats, stopped *robocopy.StoppedError) {
+	if journal == nil {
+		return
+	}
+	if stopped == nil && stats.ExitCode >= 0 && stats.ExitCode < 8 {
+		journal.remove()
+		return
 	}
-	logger.Debugf("%+v", stats)
+	keepJournal()
+}
 
-	return stats.Copied.Files, stats.Copied.Bytes, nil
+// keepJournal closes the journal of a job that did not complete and tells how to resume it
+func keepJournal() {
+	journal.close()
+	fmt.Println(helpStyle.Render("Resume this job with: ") + ProgramName + " resume " + journal.ID)
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/text/encoding"
+
+	"rbcp/robocopy"
+)
+
+// # --record and rbcp replay
+// A recording holds the raw output of every robocopy run of a job, with the time each chunk was read, to debug the
+// parser and the TUI without robocopy. It is a JSON object per line: the header, then for every run a line with its
+// arguments followed by the chunks of its output. Replaying feeds the chunks through the parser and the TUI with the
+// original timing.
+//
+//	{"version":1,"created":"2025-01-06T10:00:00Z","rbcp":"v1.5.0","root":"C:/src/","job":{...},"encoding":"850"}
+//	{"run":1,"t":0.002,"args":["C:/src","D:/dst","/L",...]}
+//	{"run":1,"t":0.031,"data":"<base64>"}
+
+const recordingVersion = 1
+
+// recordEntry is a line of a recording
+type recordEntry struct {
+	// header
+	Version  int           `json:"version,omitempty"`
+	Created  *time.Time    `json:"created,omitempty"`
+	Rbcp     string        `json:"rbcp,omitempty"`
+	Root     string        `json:"root,omitempty"`
+	Job      *robocopy.Job `json:"job,omitempty"`
+	Encoding string        `json:"encoding,omitempty"`
+	Language string        `json:"language,omitempty"`
+
+	// Run is the number of the robocopy run, from 1, and T the seconds since the recording started
+	Run  int      `json:"run,omitempty"`
+	T    float64  `json:"t,omitempty"`
+	Args []string `json:"args,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+}
+
+// Recording writes the output of robocopy to a recording as it is read, see robocopy.Recorder
+type Recording struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	enc   *json.Encoder
+	start time.Time
+	runs  int
+	// failed is set once writing failed, which is only reported once
+	failed bool
+}
+
+// newRecording creates the recording at path for job
+func newRecording(path string, job robocopy.Job) (*Recording, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recording{path: path, file: f, enc: json.NewEncoder(f), start: time.Now()}
+	root, _ := job.AbsRoot()
+	// : the codepage of this machine, which the recording is replayed in
+	codepage := config.RobocopyEncoding
+	if codepage == "" || codepage == "auto" {
+		codepage = robocopy.DefaultEncoding()
+	}
+	r.write(recordEntry{Version: recordingVersion, Created: &r.start, Rbcp: Version, Root: root, Job: &job,
+		Encoding: codepage, Language: config.RobocopyLanguage})
+	return r, nil
+}
+
+func (r *Recording) write(e recordEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil && !r.failed {
+		r.failed = true
+		logger.Warnf("could not write to the recording %v: %v", r.path, err)
+	}
+}
+
+// Record starts the recording of a robocopy run
+func (r *Recording) Record(args []string) io.Writer {
+	r.mu.Lock()
+	r.runs++
+	run := r.runs
+	r.mu.Unlock()
+	r.write(recordEntry{Run: run, T: r.elapsed(), Args: args})
+	return recordWriter{r, run}
+}
+
+func (r *Recording) elapsed() float64 {
+	return time.Since(r.start).Seconds()
+}
+
+// recordWriter writes chunks of the output of a run to the recording
+type recordWriter struct {
+	r   *Recording
+	run int
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w.r.write(recordEntry{Run: w.run, T: w.r.elapsed(), Data: p})
+	return len(p), nil
+}
+
+// # rbcp replay
+
+type ReplayCmd struct {
+	CommonFlags
+	File  string `arg:"positional,required" placeholder:"FILE" help:"recording made with --record"`
+	Speed string `arg:"--speed" placeholder:"FACTOR" default:"1x" help:"replay faster, e.g. 4x, or slower, e.g. 0.5x"`
+}
+
+func (ReplayCmd) Description() string {
+	return "Replay a recording of robocopy's output made with --record, through the parser and the progress display.\n"
+}
+
+// recordedRun is a run of robocopy in a recording
+type recordedRun struct {
+	T      float64
+	Args   []string
+	Chunks []recordEntry
+}
+
+// parse parses the whole output of the run at once
+func (r recordedRun) parse(ctx context.Context, enc encoding.Encoding, lang *robocopy.Language) robocopy.Stats {
+	data := make([]byte, 0)
+	for _, c := range r.Chunks {
+		data = append(data, c.Data...)
+	}
+	var stats robocopy.Stats
+	if err := robocopy.ParseStreamingIn(ctx, robocopy.Decode(bytes.NewReader(data), enc), lang, &stats, nil); err != nil {
+		logger.Errorf("Could not parse the run %v: %v", r.Args, err)
+	}
+	return stats
+}
+
+// duration returns how long the run took, until its last output
+func (r recordedRun) duration() time.Duration {
+	if len(r.Chunks) == 0 {
+		return 0
+	}
+	return time.Duration((r.Chunks[len(r.Chunks)-1].T - r.T) * float64(time.Second))
+}
+
+// listOnly reports whether the run was a list pass
+func (r recordedRun) listOnly() bool {
+	return slices.ContainsFunc(r.Args, func(a string) bool { return strings.EqualFold(a, "/L") })
+}
+
+func runReplayCmd(argv []string) {
+	var cmd ReplayCmd
+	parser := parseSubcommand("replay", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	initWidth := setup()
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(cmd.Speed), "x"), 64)
+	if err != nil || speed <= 0 {
+		parser.Fail("--speed must be a positive factor, e.g. 4x")
+	}
+
+	header, runs, err := readRecording(cmd.File)
+	if err != nil {
+		logger.Fatalf("Cannot read the recording: %v", err)
+	}
+	lang, err := robocopy.LookupLanguage(header.Language)
+	if err != nil {
+		logger.Fatalf("Invalid recording: %v", err)
+	}
+	enc, err := robocopy.LookupEncoding(header.Encoding)
+	if err != nil {
+		logger.Fatalf("Invalid recording: %v", err)
+	}
+	logger.Infof("Replaying %v, recorded by rbcp %v on %v", cmd.File, header.Rbcp, header.Created)
+	if header.Job != nil {
+		fmt.Println(lipgloss.PlaceHorizontal(initWidth, lipgloss.Center,
+			pathStyle.Render(header.Root)+headerArrow()+pathStyle.Render(header.Job.Dest)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stats robocopy.Stats
+	var totals *robocopy.Stats
+	replayed := false
+	for i, run := range runs {
+		// : list passes give the totals of the next copy, as they do when copying
+		if run.listOnly() {
+			stats = run.parse(ctx, enc, lang)
+			totals = &stats
+			continue
+		}
+		if totals == nil {
+			logger.Warnf("Run %d has no list pass before it, taking the totals from its summary", i+1)
+			totals = new(robocopy.Stats)
+			*totals = run.parse(ctx, enc, lang)
+		}
+		var m model
+		stats, m = replayRun(ctx, cancel, run, header.Root, enc, lang, speed,
+			newModel(totals.Copied.Files, totals.Copied.Bytes, initWidth))
+		totals = nil
+		replayed = true
+		if m.ForceQuit {
+			break
+		}
+	}
+	if !replayed {
+		logger.Warnf("%v holds no copy, showing the summary of its last list pass", cmd.File)
+	}
+	stats.ExitCode = logExitCode(stats)
+	displaySummary(stats, nil)
+}
+
+// readRecording reads the header and the runs of the recording at path
+func readRecording(path string) (header recordEntry, runs []recordedRun, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return header, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch {
+		case line == 1:
+			if e.Version != recordingVersion {
+				return header, nil, fmt.Errorf("unsupported recording version %d", e.Version)
+			}
+			header = e
+		case e.Run < 1 || e.Run > len(runs)+1:
+			return header, nil, fmt.Errorf("line %d: unexpected run %d", line, e.Run)
+		case e.Run == len(runs)+1:
+			runs = append(runs, recordedRun{T: e.T, Args: e.Args})
+		default:
+			runs[e.Run-1].Chunks = append(runs[e.Run-1].Chunks, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, err
+	}
+	if line == 0 {
+		return header, nil, errors.New("empty recording")
+	}
+	return header, runs, nil
+}
+
+// replayRun feeds the output of a run through the parser and the TUI of m, waiting between chunks as long as robocopy
+// did divided by speed
+func replayRun(ctx context.Context, cancel context.CancelFunc, run recordedRun, root string, enc encoding.Encoding,
+	lang *robocopy.Language, speed float64, m model) (stats robocopy.Stats, _ model) {
+	r, w := io.Pipe()
+	go func() {
+		last := run.T
+		for _, c := range run.Chunks {
+			select {
+			case <-time.After(time.Duration((c.T - last) / speed * float64(time.Second))):
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+			last = c.T
+			w.Write(c.Data)
+		}
+		w.Close()
+	}()
+
+	m.threads = robocopy.Options{Extra: run.Args}.ThreadCount()
+	// : robocopy prints no times with /NJS, nor when it was interrupted
+	defer func() {
+		if stats.Duration == 0 {
+			stats.Duration = run.duration()
+		}
+	}()
+	if m.totalBytes == 0 {
+		// : like a copy, without the TUI when there is nothing to copy
+		robocopy.ParseStreamingIn(ctx, robocopy.Decode(r, enc), lang, &stats, nil)
+		return stats, m
+	}
+	p = tea.NewProgram(m)
+	ended := make(chan struct{})
+	go func() {
+		t, err := p.Run()
+		if err != nil {
+			logger.Fatal("error running program:", err)
+		}
+		m = t.(model)
+		if m.ForceQuit {
+			cancel()
+		}
+		close(ended)
+	}()
+	obs := summaryObserver{Observer: newTeaObserver(p, root)}
+	if err := robocopy.ParseStreamingIn(ctx, robocopy.Decode(r, enc), lang, &stats, &obs); err != nil || !obs.done {
+		// : the TUI only quits by itself on the summary
+		p.Quit()
+	}
+	<-ended
+	return stats, m
+}
@@ -0,0 +1,124 @@
+package robocopy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+var (
+	utf16LE = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	utf16BE = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+
+	// Byte order marks
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// Codepages are the windows codepages robocopy can print its output in, by number
+var Codepages = map[int]encoding.Encoding{
+	437:   charmap.CodePage437,
+	850:   charmap.CodePage850,
+	852:   charmap.CodePage852,
+	855:   charmap.CodePage855,
+	858:   charmap.CodePage858,
+	860:   charmap.CodePage860,
+	862:   charmap.CodePage862,
+	863:   charmap.CodePage863,
+	865:   charmap.CodePage865,
+	866:   charmap.CodePage866,
+	874:   charmap.Windows874,
+	932:   japanese.ShiftJIS,
+	936:   simplifiedchinese.GBK,
+	949:   korean.EUCKR,
+	950:   traditionalchinese.Big5,
+	1200:  utf16LE,
+	1201:  utf16BE,
+	1250:  charmap.Windows1250,
+	1251:  charmap.Windows1251,
+	1252:  charmap.Windows1252,
+	1253:  charmap.Windows1253,
+	1254:  charmap.Windows1254,
+	1255:  charmap.Windows1255,
+	1256:  charmap.Windows1256,
+	1257:  charmap.Windows1257,
+	1258:  charmap.Windows1258,
+	20866: charmap.KOI8R,
+	28591: charmap.ISO8859_1,
+	28592: charmap.ISO8859_2,
+	28605: charmap.ISO8859_15,
+	65001: unicode.UTF8,
+}
+
+// LookupEncoding returns the encoding named name: a codepage number ("850", "cp1252") or an IANA name
+// ("utf-16le", "windows-1252", "shift_jis"). "" or auto returns the encoding robocopy prints in by default, the
+// console codepage on windows and the locale's elsewhere, or nil for UTF-8.
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "auto" {
+		// : an unknown default is not the user's fault, the output is parsed as UTF-8
+		enc, _ := LookupEncoding(DefaultEncoding())
+		if enc == unicode.UTF8 {
+			return nil, nil
+		}
+		return enc, nil
+	}
+	number := strings.TrimPrefix(strings.TrimPrefix(name, "cp"), "ibm")
+	if cp, err := strconv.Atoi(number); err == nil {
+		if enc, ok := Codepages[cp]; ok {
+			return enc, nil
+		}
+		return nil, fmt.Errorf("unsupported codepage %v", cp)
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	return enc, nil
+}
+
+// Decode returns a reader of r transcoded to UTF-8, in the encoding DetectEncoding returns for its first bytes. A nil
+// enc passes output without a byte order mark that is not UTF-16 through as is.
+func Decode(r io.Reader, enc encoding.Encoding) io.Reader {
+	br := bufio.NewReader(r)
+	// : blocks until robocopy printed something, which it does right away
+	head, _ := br.Peek(len(bomUTF8))
+	enc = DetectEncoding(head, enc)
+	if enc == nil || enc == unicode.UTF8 {
+		return br
+	}
+	return transform.NewReader(br, enc.NewDecoder())
+}
+
+// DetectEncoding returns the encoding of output starting with head (at least 3 bytes of it). Output starting with a
+// byte order mark, or UTF-16 output as robocopy prints it with /UNICODE (or writes it with /UNILOG), is decoded as
+// such, anything else as enc.
+func DetectEncoding(head []byte, enc encoding.Encoding) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(head, bomUTF8):
+		return unicode.UTF8BOM
+	case bytes.HasPrefix(head, bomUTF16LE), bytes.HasPrefix(head, bomUTF16BE):
+		// : the byte order mark sets the endianness
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	// : robocopy output starts with ASCII, every other byte of which is zero in UTF-16
+	case len(head) >= 2 && head[0] != 0 && head[1] == 0:
+		return utf16LE
+	case len(head) >= 2 && head[0] == 0 && head[1] != 0:
+		return utf16BE
+	}
+	return enc
+}
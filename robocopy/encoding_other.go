@@ -0,0 +1,24 @@
+//go:build !windows
+
+package robocopy
+
+import (
+	"os"
+	"strings"
+)
+
+// DefaultEncoding returns the charset of the locale, e.g. "ISO-8859-1" for de_DE.ISO-8859-1, UTF-8 without one
+func DefaultEncoding() string {
+	for _, env := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		locale := os.Getenv(env)
+		if locale == "" {
+			continue
+		}
+		locale, _, _ = strings.Cut(locale, "@")
+		if _, charset, ok := strings.Cut(locale, "."); ok {
+			return charset
+		}
+		return "UTF-8"
+	}
+	return "UTF-8"
+}
@@ -0,0 +1,18 @@
+package robocopy
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetOEMCP = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetOEMCP")
+
+// DefaultEncoding returns the codepage robocopy prints in: the console's, or the OEM codepage without a console
+func DefaultEncoding() string {
+	if cp, err := windows.GetConsoleOutputCP(); err == nil && cp != 0 {
+		return strconv.Itoa(int(cp))
+	}
+	cp, _, _ := procGetOEMCP.Call()
+	return strconv.Itoa(int(cp))
+}
@@ -0,0 +1,157 @@
+package robocopy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	// Rules around the banner and at the end of the header
+	reHeaderRule = regexp.MustCompile(`^-{20,}$`)
+	reBanner     = regexp.MustCompile(`^ROBOCOPY\s+::`)
+)
+
+// JobHeader is the header robocopy prints before copying, with the options it resolved
+type JobHeader struct {
+	// Started is when robocopy started, as printed by robocopy, see StartTime
+	Started string
+	Source  string
+	Dest    string
+	// Files are the names or patterns copied, e.g. "*.*"
+	Files []string
+	// ExcludeFiles and ExcludeDirs are the /XF and /XD patterns
+	ExcludeFiles []string
+	ExcludeDirs  []string
+	// Options are the switches robocopy runs with, including its defaults, e.g. "/DCOPY:DA" "/COPY:DAT" "/R:2"
+	Options []string
+
+	// Error is the fatal error robocopy printed instead of copying, e.g. `Invalid Parameter #3 : "/foo"`
+	Error string
+	// Rejected is the switch robocopy rejected as an invalid parameter, and RejectedIndex its position from 1
+	Rejected      string
+	RejectedIndex int
+
+	// Language is the name of the language robocopy printed its output in, see Languages
+	Language string
+}
+
+// field sets a field of the header, returning the list further lines of the field are added to, if any
+func (h *JobHeader) field(name, value string) *[]string {
+	var list *[]string
+	switch name {
+	case "Started":
+		h.Started = value
+	case "Source":
+		h.Source = value
+	case "Dest":
+		h.Dest = value
+	case "Files":
+		list = &h.Files
+	case "Exc Files":
+		list = &h.ExcludeFiles
+	case "Exc Dirs":
+		list = &h.ExcludeDirs
+	case "Options":
+		// : the options start with the files again
+		h.Options = slices.DeleteFunc(strings.Fields(value), func(o string) bool { return !strings.HasPrefix(o, "/") })
+	}
+	if list != nil && value != "" {
+		*list = append(*list, value)
+	}
+	return list
+}
+
+// StartTime parses Started in the language of the header, in the local time zone
+func (h JobHeader) StartTime() (time.Time, error) {
+	return ParseTime(h.Started, Languages[h.Language])
+}
+
+// ParseTime parses a date and time as robocopy prints them in lang (English if nil), e.g.
+// "Monday, January 6, 2025 10:00:00 AM" or "Montag, 6. Januar 2025 10:00:00", in the local time zone
+func ParseTime(s string, lang *Language) (time.Time, error) {
+	if lang == nil {
+		lang = English
+	}
+	var year, month, day, hour, minute, second int
+	pm, am := false, false
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		f = strings.TrimSuffix(f, ".")
+		if n, err := strconv.Atoi(f); err == nil {
+			if len(f) == 4 {
+				year = n
+			} else {
+				day = n
+			}
+			continue
+		}
+		switch {
+		case strings.Count(f, ":") == 2:
+			fmt.Sscanf(f, "%d:%d:%d", &hour, &minute, &second)
+		case strings.EqualFold(f, "PM"):
+			pm = true
+		case strings.EqualFold(f, "AM"):
+			am = true
+		default:
+			// : older robocopy prints "Mon Jan 06 10:00:00 2025"
+			for i := range English.Months {
+				if i < len(lang.Months) && strings.EqualFold(f, lang.Months[i]) || strings.EqualFold(f, English.Months[i]) ||
+					strings.EqualFold(f, English.Months[i][:3]) {
+					month = i + 1
+				}
+			}
+		}
+	}
+	if year == 0 || month == 0 || day == 0 {
+		return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+	}
+	if pm && hour < 12 {
+		hour += 12
+	} else if am && hour == 12 {
+		hour = 0
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, time.Local), nil
+}
+
+// err returns the error robocopy reported in the header when run with args, nil if there is none
+func (h JobHeader) err(args []string) error {
+	if h.Error == "" {
+		return nil
+	}
+	if h.Rejected != "" {
+		return &InvalidParameterError{Args: args, Index: h.RejectedIndex, Param: h.Rejected}
+	}
+	return errors.New("robocopy: " + h.Error)
+}
+
+// InvalidParameterError is returned when robocopy rejects one of its arguments and copies nothing
+type InvalidParameterError struct {
+	// Args robocopy was run with
+	Args []string
+	// Index of the rejected argument in Args, from 1 as robocopy counts them
+	Index int
+	// Param is the rejected argument, as robocopy prints it
+	Param string
+}
+
+func (e *InvalidParameterError) Error() string {
+	return fmt.Sprintf("robocopy rejected parameter #%d %q", e.Index, e.Param)
+}
+
+// Position returns the index of the rejected argument in Args, or -1 if it cannot be found
+func (e *InvalidParameterError) Position() int {
+	if i := e.Index - 1; i >= 0 && i < len(e.Args) && strings.EqualFold(e.Args[i], e.Param) {
+		return i
+	}
+	for i, a := range e.Args {
+		if strings.EqualFold(a, e.Param) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,413 @@
+package robocopy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the robocopy flags of a Job
+type Options struct {
+	// Mirror passes /MIR, i.e. also deletes extra files in the destination
+	Mirror bool
+	// Threads passes /MT:N if non-zero
+	Threads int
+	// Retries and Wait pass /R:N and /W:N if set, robocopy's defaults are 1 million retries 30 seconds apart
+	Retries *int
+	Wait    *int
+	// ExcludeFiles and ExcludeDirs pass /XF and /XD
+	ExcludeFiles []string
+	ExcludeDirs  []string
+	// Extra arguments passed to robocopy as is
+	Extra []string
+}
+
+// Purges reports whether robocopy deletes extra files and directories from the destination, with /MIR or /PURGE
+func (o Options) Purges() bool {
+	if o.Mirror {
+		return true
+	}
+	return slices.ContainsFunc(o.Extra, func(e string) bool {
+		e = strings.ToLower(e)
+		return e == "/mir" || e == "/purge"
+	})
+}
+
+// Recursive reports whether robocopy copies subdirectories, with /S, /E or /MIR
+func (o Options) Recursive() bool {
+	if o.Mirror {
+		return true
+	}
+	return slices.ContainsFunc(o.Extra, func(e string) bool {
+		e = strings.ToLower(e)
+		return e == "/mir" || e == "/e" || e == "/s"
+	})
+}
+
+// ThreadCount returns the number of threads robocopy copies with, from Threads or /MT[:N] in Extra, 0 without /MT
+func (o Options) ThreadCount() int {
+	if o.Threads > 0 {
+		return o.Threads
+	}
+	threads := 0
+	for _, e := range o.Extra {
+		e = strings.ToLower(e)
+		if e == "/mt" {
+			// : robocopy's default
+			threads = 8
+		} else if n, ok := strings.CutPrefix(e, "/mt:"); ok {
+			threads, _ = strconv.Atoi(n)
+		}
+	}
+	return threads
+}
+
+// Moves reports whether robocopy deletes the copied files from the source, with /MOV or /MOVE
+func (o Options) Moves() bool {
+	return slices.ContainsFunc(o.Extra, func(e string) bool {
+		e = strings.ToLower(e)
+		return e == "/mov" || e == "/move"
+	})
+}
+
+// Job is a single robocopy invocation. It is a plain value, so any number of jobs can be run concurrently.
+type Job struct {
+	// Sources are either a single directory, whose contents are copied, or any number of files in the same directory
+	Sources []string
+	Dest    string
+	Options Options
+	// StallTimeout stops Run when robocopy has printed nothing (no file, progress, error or directory) for that long,
+	// 0 disables it
+	StallTimeout time.Duration
+	// Language robocopy prints its output in (see Languages), empty or auto to detect it from the header
+	Language string `json:",omitempty"`
+	// Encoding of robocopy's output (see LookupEncoding), empty or auto for the console codepage. Output with a byte
+	// order mark or in UTF-16 (/UNICODE) is always detected.
+	Encoding string `json:",omitempty"`
+	// Recorder, if set, receives the raw output of every robocopy run of the job
+	Recorder Recorder `json:"-"`
+}
+
+// Recorder records the raw output of robocopy, e.g. to replay it later
+type Recorder interface {
+	// Record is called with the arguments of every run of robocopy, and returns the writer its output is copied to as
+	// it is read. Errors writing to it are ignored.
+	Record(args []string) io.Writer
+}
+
+// recordOutput returns r copied to the recorder of the job as it is read, if it has one
+func (j Job) recordOutput(args []string, r io.Reader) io.Reader {
+	if j.Recorder == nil {
+		return r
+	}
+	return io.TeeReader(r, ignoreErrors{j.Recorder.Record(args)})
+}
+
+// ignoreErrors is a writer that cannot fail, so recording never stops robocopy
+type ignoreErrors struct {
+	io.Writer
+}
+
+func (w ignoreErrors) Write(p []byte) (int, error) {
+	w.Writer.Write(p)
+	return len(p), nil
+}
+
+// waitDelay is how long to wait for robocopy's output to be closed after it was killed
+const waitDelay = 5 * time.Second
+
+// outputNotAllowed are flags that change robocopy output in ways the parser cannot handle
+var outputNotAllowed = []string{"/bytes", "/np", "/njh", "/njs", "/ndl", "/nfl", "/ns"}
+
+// Split breaks the sources into the directory robocopy copies from and the files (names) to copy from it.
+// files is empty if the source is a single directory.
+func (j Job) Split() (root string, files []string, err error) {
+	if len(j.Sources) == 0 {
+		return "", nil, errors.New("no source specified")
+	}
+	for _, src := range j.Sources {
+		// normalize paths; mvdan/sh has some weird behaviour i.e.
+		// paths in globs are /-separated whereas paths in braces are \-separated
+		src = filepath.ToSlash(src)
+		info, err := os.Stat(src)
+		if err != nil {
+			return "", nil, err
+		}
+		if info.IsDir() && len(j.Sources) == 1 {
+			return src, nil, nil
+		}
+		p, f := filepath.Split(src)
+		if p == "" {
+			p = "./"
+		}
+		if root == "" {
+			root = p
+		}
+		if root != p {
+			return "", nil, fmt.Errorf("all sources must be in the same directory, %v is not in %v", src, root)
+		}
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return root, files, nil
+}
+
+// AbsRoot returns the absolute directory robocopy copies from (see Split), with forward slashes and a trailing one
+func (j Job) AbsRoot() (string, error) {
+	root, _, err := j.Split()
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return withSlash(root), nil
+}
+
+// AbsDest returns the absolute destination directory, with forward slashes and a trailing one
+func (j Job) AbsDest() (string, error) {
+	dest, err := filepath.Abs(j.Dest)
+	if err != nil {
+		return "", err
+	}
+	return withSlash(dest), nil
+}
+
+// RelPath returns path relative to root (as returned by AbsRoot), with forward slashes.
+// ok is false if path is not inside root.
+func RelPath(root, path string) (rel string, ok bool) {
+	return cutPrefixFold(filepath.ToSlash(path), root)
+}
+
+// Args builds the robocopy arguments for the job, without any flags controlling the output
+func (j Job) Args() ([]string, error) {
+	root, files, err := j.Split()
+	if err != nil {
+		return nil, err
+	}
+	o := j.Options
+	out := []string{root, j.Dest}
+	out = slices.Concat(out, files, o.Extra)
+	if o.Mirror {
+		out = append(out, "/MIR")
+	}
+	if o.Threads > 0 {
+		out = append(out, "/MT:"+strconv.Itoa(o.Threads))
+	}
+	if len(o.ExcludeFiles) > 0 {
+		out = append(out, "/XF")
+		out = append(out, o.ExcludeFiles...)
+	}
+	if len(o.ExcludeDirs) > 0 {
+		out = append(out, "/XD")
+		out = append(out, o.ExcludeDirs...)
+	}
+	if o.Retries != nil {
+		out = append(out, "/R:"+strconv.Itoa(*o.Retries))
+	}
+	if o.Wait != nil {
+		out = append(out, "/W:"+strconv.Itoa(*o.Wait))
+	}
+	return out, nil
+}
+
+// RunArgs builds the arguments used by Run, i.e. Args with the output flags the parser needs
+func (j Job) RunArgs() ([]string, error) {
+	out, err := j.Args()
+	if err != nil {
+		return nil, err
+	}
+	out = slices.DeleteFunc(out, func(e string) bool {
+		return slices.Contains(outputNotAllowed, strings.ToLower(e))
+	})
+	// let user log if wanted, but we need output to function so tee it
+	for _, e := range out {
+		e = strings.ToLower(e)
+		if strings.HasPrefix(e, "/log") || strings.HasPrefix(e, "/unilog") {
+			out = append(out, "/TEE")
+			break
+		}
+	}
+	// : /FP to know which directory each file is in, as directory lines are dropped with /NDL
+	return append(out, "/NDL", "/FP", "/BYTES"), nil
+}
+
+// CountArgs builds the arguments used by Count, i.e. RunArgs in list-only mode without per file output
+func (j Job) CountArgs() ([]string, error) {
+	out, err := j.RunArgs()
+	if err != nil {
+		return nil, err
+	}
+	return append(out, "/L", "/NFL", "/NDL", "/NP", "/NC"), nil
+}
+
+// ListArgs builds the arguments used by List, i.e. RunArgs in list-only mode, with directory lines for extra ones
+func (j Job) ListArgs() ([]string, error) {
+	out, err := j.RunArgs()
+	if err != nil {
+		return nil, err
+	}
+	out = slices.DeleteFunc(out, func(e string) bool { return e == "/NDL" })
+	return append(out, "/L", "/NP"), nil
+}
+
+// Command returns the robocopy command for the job (see Args), with extra arguments appended
+func (j Job) Command(ctx context.Context, extra ...string) (*exec.Cmd, error) {
+	args, err := j.Args()
+	if err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, "robocopy", append(args, extra...)...), nil
+}
+
+// Run runs robocopy, reporting events to obs (which can be nil) while it runs, and returns the statistics from the
+// summary. Cancelling ctx kills robocopy, in which case the stats parsed so far are returned along with a
+// *StoppedError wrapping the cause (see context.Cause), as they are when robocopy stalls for StallTimeout.
+func (j Job) Run(ctx context.Context, obs Observer) (Stats, error) {
+	args, err := j.RunArgs()
+	if err != nil {
+		return Stats{}, err
+	}
+	return j.run(ctx, args, obs)
+}
+
+// Listing is the result of a list-only pass
+type Listing struct {
+	// Files that would be copied, with their full path
+	Files []FileEvent
+	// Dirs that would be created, with their full path
+	Dirs []FileEvent
+	// Extras are the files and directories in the destination that are not in the source, with their full path
+	Extras []FileEvent
+	// Same are the files skipped as unchanged, only listed with /V
+	Same  []FileEvent
+	Stats Stats
+}
+
+// List runs robocopy in list-only mode and returns every file that would be copied and every extra
+func (j Job) List(ctx context.Context) (Listing, error) {
+	args, err := j.ListArgs()
+	if err != nil {
+		return Listing{}, err
+	}
+	var l listCollector
+	l.Stats, err = j.run(ctx, args, &l)
+	return l.Listing, err
+}
+
+// listCollector collects the events of a list pass
+type listCollector struct {
+	NopObserver
+	Listing
+}
+
+func (c *listCollector) OnFile(e FileEvent) {
+	c.Files = append(c.Files, e)
+}
+
+func (c *listCollector) OnDir(e FileEvent) {
+	c.Dirs = append(c.Dirs, e)
+}
+
+func (c *listCollector) OnExtra(e FileEvent) {
+	c.Extras = append(c.Extras, e)
+}
+
+func (c *listCollector) OnSkipped(e FileEvent) {
+	c.Same = append(c.Same, e)
+}
+
+// run runs robocopy with args, see Run
+func (j Job) run(ctx context.Context, args []string, obs Observer) (Stats, error) {
+	var stats Stats
+	lang, err := LookupLanguage(j.Language)
+	if err != nil {
+		return stats, err
+	}
+	enc, err := LookupEncoding(j.Encoding)
+	if err != nil {
+		return stats, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	watch := newWatchdog(obs)
+	if j.StallTimeout > 0 {
+		go watch.watch(ctx, cancel, j.StallTimeout)
+	}
+
+	startTime := time.Now()
+	cmd := exec.CommandContext(ctx, "robocopy", args...)
+	// : don't hang on Wait if a killed robocopy leaves the pipe open
+	cmd.WaitDelay = waitDelay
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return stats, fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	output := j.recordOutput(args, stdout)
+	if err := cmd.Start(); err != nil {
+		return stats, fmt.Errorf("failed to start robocopy: %v", err)
+	}
+
+	// : returns once robocopy exits (or is killed) and closes stdout
+	parseErr := ParseStreamingIn(ctx, Decode(watch.reader(output), enc), lang, &stats, watch)
+	cmd.Wait()
+	stats.Duration = time.Since(startTime)
+	stats.ExitCode = cmd.ProcessState.ExitCode()
+
+	if ctx.Err() != nil {
+		return stats, watch.stopped(context.Cause(ctx))
+	}
+	// Non-fatal error handling (robocopy uses exit codes for normal operations)
+	if parseErr != nil && stats.ExitCode > 16 {
+		return stats, fmt.Errorf("robocopy failed with exit code %d: %v", stats.ExitCode, parseErr)
+	}
+	return stats, stats.Header.err(args)
+}
+
+// Count runs robocopy in list-only mode to get the total files and bytes that would be copied
+func (j Job) Count(ctx context.Context) (files int, bytesTotal int64, err error) {
+	args, err := j.CountArgs()
+	if err != nil {
+		return 0, 0, err
+	}
+	lang, err := LookupLanguage(j.Language)
+	if err != nil {
+		return 0, 0, err
+	}
+	enc, err := LookupEncoding(j.Encoding)
+	if err != nil {
+		return 0, 0, err
+	}
+	cmd := exec.CommandContext(ctx, "robocopy", args...)
+	cmd.WaitDelay = waitDelay
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return 0, 0, context.Cause(ctx)
+	}
+	if err != nil && cmd.ProcessState == nil {
+		return 0, 0, fmt.Errorf("failed to start robocopy: %v", err)
+	}
+	if err != nil && cmd.ProcessState.ExitCode() > 16 {
+		return 0, 0, fmt.Errorf("robocopy failed with exit code %d: %v", cmd.ProcessState.ExitCode(), err)
+	}
+
+	var stats Stats
+	if err := ParseStreamingIn(ctx, Decode(j.recordOutput(args, bytes.NewReader(output)), enc), lang, &stats, nil); err != nil {
+		return 0, 0, err
+	}
+	if err := stats.Header.err(args); err != nil {
+		return 0, 0, err
+	}
+	return stats.Copied.Files, stats.Copied.Bytes, nil
+}
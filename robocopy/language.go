@@ -0,0 +1,268 @@
+package robocopy
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Language holds the keywords robocopy prints in one display language, by their English text. Every keyword can list
+// alternative spellings separated by |, as they vary between windows versions.
+type Language struct {
+	// Name is the code of the language, e.g. "de"
+	Name string
+	// Banner is the title of the header, after "ROBOCOPY ::"
+	Banner string
+	// Header are the labels of the header fields: Started, Source, Dest, Files, Exc Files, Exc Dirs and Options
+	Header map[string]string
+	// Classes of files and directories: New File, Newer, Older, Changed, Modified, Tweaked, File, New Dir, same,
+	// *EXTRA File and *EXTRA Dir
+	Classes map[string]string
+	// Summary are the columns (Total, Copied, Skipped, Mismatch, FAILED, Extras), rows (Dirs, Files, Bytes, Times),
+	// speeds (Speed, Bytes/sec, MegaBytes/min) and end time (Ended) of the summary
+	Summary map[string]string
+	// Months are the names of the months, from January, as robocopy prints them in the Started and Ended times
+	Months []string
+	// Error starts error lines, InvalidParameter is the error for a rejected switch
+	Error            string
+	InvalidParameter string
+}
+
+// English is the language the parser falls back to when robocopy prints no header
+var English = &Language{
+	Name:   "en",
+	Banner: "Robust File Copy for Windows",
+	Header: map[string]string{
+		"Started": "Started", "Source": "Source", "Dest": "Dest", "Files": "Files", "Exc Files": "Exc Files",
+		"Exc Dirs": "Exc Dirs", "Options": "Options",
+	},
+	Classes: map[string]string{
+		"New File": "New File", "Newer": "Newer", "Older": "Older", "Changed": "Changed", "Modified": "Modified",
+		"Tweaked": "Tweaked", "File": "File", "New Dir": "New Dir", "same": "same", "*EXTRA File": "*EXTRA File",
+		"*EXTRA Dir": "*EXTRA Dir",
+	},
+	Summary: map[string]string{
+		"Total": "Total", "Copied": "Copied", "Skipped": "Skipped", "Mismatch": "Mismatch", "FAILED": "FAILED",
+		"Extras": "Extras", "Dirs": "Dirs", "Files": "Files", "Bytes": "Bytes", "Times": "Times", "Speed": "Speed",
+		"Bytes/sec": "Bytes/sec", "MegaBytes/min": "MegaBytes/min", "Ended": "Ended",
+	},
+	Months: []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October",
+		"November", "December"},
+	Error:            "ERROR",
+	InvalidParameter: "Invalid Parameter",
+}
+
+// Languages robocopy output can be parsed in, by their name
+var Languages = map[string]*Language{
+	"en": English,
+	"de": {
+		Name:   "de",
+		Banner: "Robustes Dateikopieren für Windows",
+		Header: map[string]string{
+			"Started": "Gestartet", "Source": "Quelle", "Dest": "Ziel", "Files": "Dateien",
+			"Exc Files": "Ausgeschl. Dateien|Exkl. Dateien", "Exc Dirs": "Ausgeschl. Verz.|Exkl. Verz.", "Options": "Optionen",
+		},
+		Classes: map[string]string{
+			"New File": "Neue Datei", "Newer": "Neuer", "Older": "Älter", "Changed": "Geändert", "Modified": "Modifiziert",
+			"Tweaked": "Optimiert", "File": "Datei", "New Dir": "Neues Verz.|Neues Verzeichnis", "same": "identisch|Gleich",
+			"*EXTRA File": "*EXTRA Datei", "*EXTRA Dir": "*EXTRA Verz.|*EXTRA Verzeichnis",
+		},
+		Summary: map[string]string{
+			"Total": "Insgesamt", "Copied": "Kopiert", "Skipped": "Übersprungen",
+			"Mismatch": "Keine Übereinstimmung|Nicht übereinstimmend", "FAILED": "FEHLER|Fehlgeschlagen", "Extras": "Extras",
+			"Dirs": "Verzeich.|Verzeichnisse", "Files": "Dateien", "Bytes": "Bytes", "Times": "Zeiten",
+			"Speed": "Geschwindigkeit", "Bytes/sec": "Bytes/Sek.", "MegaBytes/min": "Megabytes/Min.", "Ended": "Beendet",
+		},
+		Months: []string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober",
+			"November", "Dezember"},
+		Error:            "FEHLER",
+		InvalidParameter: "Ungültiger Parameter",
+	},
+	"fr": {
+		Name:   "fr",
+		Banner: "Copie de fichiers robuste pour Windows",
+		Header: map[string]string{
+			"Started": "Début|Démarrage", "Source": "Source", "Dest": "Dest|Destination", "Files": "Fichiers",
+			"Exc Files": "Fichiers exclus", "Exc Dirs": "Rép. exclus", "Options": "Options",
+		},
+		Classes: map[string]string{
+			"New File": "Nouveau fichier", "Newer": "Plus récent", "Older": "Plus ancien", "Changed": "Modifié",
+			"Modified": "Changé", "Tweaked": "Ajusté", "File": "Fichier", "New Dir": "Nouveau rép.|Nouveau répertoire",
+			"same": "identique", "*EXTRA File": "*Fichier EXTRA|*EXTRA Fichier", "*EXTRA Dir": "*Rép. EXTRA|*EXTRA Rép.",
+		},
+		Summary: map[string]string{
+			"Total": "Total", "Copied": "Copié", "Skipped": "Ignoré", "Mismatch": "Incompatibilité|Discordance",
+			"FAILED": "ÉCHEC|Échec", "Extras": "Extras", "Dirs": "Rép.|Répertoires", "Files": "Fichiers",
+			"Bytes": "Octets", "Times": "Heures|Temps", "Speed": "Vitesse", "Bytes/sec": "octets/s.|Octets/s.",
+			"MegaBytes/min": "Mégaoctets/min.", "Ended": "Fin",
+		},
+		Months: []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre",
+			"novembre", "décembre"},
+		Error:            "ERREUR",
+		InvalidParameter: "Paramètre non valide",
+	},
+	"es": {
+		Name:   "es",
+		Banner: "Copia robusta de archivos para Windows",
+		Header: map[string]string{
+			"Started": "Iniciado|Inicio", "Source": "Origen", "Dest": "Destino", "Files": "Archivos",
+			"Exc Files": "Excl. archivos|Archivos excluidos", "Exc Dirs": "Excl. directorios|Directorios excluidos",
+			"Options": "Opciones",
+		},
+		Classes: map[string]string{
+			"New File": "Nuevo archivo", "Newer": "Más reciente|Más nuevo", "Older": "Más antiguo", "Changed": "Cambiado",
+			"Modified": "Modificado", "Tweaked": "Ajustado", "File": "Archivo", "New Dir": "Nuevo directorio|Nuevo dir.",
+			"same": "igual|mismo", "*EXTRA File": "*EXTRA Archivo", "*EXTRA Dir": "*EXTRA Directorio|*EXTRA Dir",
+		},
+		Summary: map[string]string{
+			"Total": "Total", "Copied": "Copiado", "Skipped": "Omitido", "Mismatch": "No coinciden|Error de coincidencia",
+			"FAILED": "ERROR|Error", "Extras": "Extras", "Dirs": "Directorios|Dirs", "Files": "Archivos",
+			"Bytes": "Bytes", "Times": "Tiempos", "Speed": "Velocidad", "Bytes/sec": "Bytes/seg.",
+			"MegaBytes/min": "MegaBytes/min.", "Ended": "Finalizado",
+		},
+		Months: []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre",
+			"noviembre", "diciembre"},
+		Error:            "ERROR",
+		InvalidParameter: "Parámetro no válido",
+	},
+}
+
+// LookupLanguage returns the language of Languages with the given name, or nil to detect it for an empty name or auto
+func LookupLanguage(name string) (*Language, error) {
+	if name == "" || name == "auto" {
+		return nil, nil
+	}
+	if lang, ok := Languages[strings.ToLower(name)]; ok {
+		return lang, nil
+	}
+	names := make([]string, 0, len(Languages))
+	for name := range Languages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return nil, fmt.Errorf("unknown robocopy language %q, use auto or one of %v", name, strings.Join(names, ", "))
+}
+
+// languagesByName returns Languages sorted by name, English first
+func languagesByName() []*Language {
+	langs := make([]*Language, 0, len(Languages))
+	for _, lang := range Languages {
+		langs = append(langs, lang)
+	}
+	slices.SortFunc(langs, func(a, b *Language) int {
+		if (a == English) != (b == English) {
+			if a == English {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return langs
+}
+
+// english returns the English keyword of a localized one matched by a pattern
+func english(keywords map[string]string, localized string) string {
+	if key, ok := keywords[strings.Join(strings.Fields(localized), " ")]; ok {
+		return key
+	}
+	return localized
+}
+
+// patterns are the regular expressions matching the output of robocopy in one language
+type patterns struct {
+	lang *Language
+	// detect matches the banner or the Started field of the header
+	detect *regexp.Regexp
+
+	// fileCopying matches the files robocopy copies, e.g. "New File  1024  C:\src\a.txt", newDir the directories that
+	// do not exist in the destination yet (with their number of files) and same the files skipped as unchanged (only
+	// printed with /V)
+	fileCopying, newDir, same *regexp.Regexp
+	// extra matches files and directories in the destination that are not in the source, e.g.
+	// "*EXTRA File  1024  D:\dst\a.txt". Directories show their number of files instead of a size.
+	extra *regexp.Regexp
+	// errorLine matches errors, e.g. "2025/01/02 10:00:00 ERROR 5 (0x00000005) Copying File C:\src\a.txt"
+	errorLine *regexp.Regexp
+
+	// headerField matches the fields of the header, e.g. "Source : C:\src\", or "Source - C:\src\" when robocopy
+	// rejects its parameters. headerError matches the fatal errors printed after the header instead of copying, e.g.
+	// `ERROR : Invalid Parameter #3 : "/foo"`, whose message invalidParameter matches.
+	headerField, headerError, invalidParameter *regexp.Regexp
+
+	summaryStart, dirs, files, bytes, times, speedBytes, speedMB, ended *regexp.Regexp
+
+	// classes and fields map the localized classes and header labels back to English
+	classes, fields map[string]string
+}
+
+var (
+	patternsMu    sync.Mutex
+	patternsCache = make(map[*Language]*patterns)
+)
+
+// patterns returns the compiled patterns of l
+func (l *Language) patterns() *patterns {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+	if p, ok := patternsCache[l]; ok {
+		return p
+	}
+	p := &patterns{lang: l, classes: make(map[string]string), fields: make(map[string]string)}
+	// : alternatives matching the localized keywords, longest first, mapped back to the English keywords in english
+	alt := func(english, words map[string]string, keys ...string) string {
+		all := make([]string, 0)
+		for _, key := range keys {
+			for _, word := range strings.Split(words[key], "|") {
+				word = strings.TrimSpace(word)
+				if word == "" {
+					continue
+				}
+				if english != nil {
+					english[word] = key
+				}
+				all = append(all, strings.ReplaceAll(regexp.QuoteMeta(word), " ", `\s+`))
+			}
+		}
+		slices.SortStableFunc(all, func(a, b string) int { return len(b) - len(a) })
+		return "(?:" + strings.Join(all, "|") + ")"
+	}
+	word := func(words string) string {
+		return alt(nil, map[string]string{"": words}, "")
+	}
+	summary := func(key string) string {
+		return alt(nil, l.Summary, key)
+	}
+	number := `([0-9.,]+\s*[kmgtKMGT]?)`
+	columns := `\s*:\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)`
+
+	p.detect = regexp.MustCompile(`^(?:ROBOCOPY\s+::\s+` + word(l.Banner) + `|` + alt(nil, l.Header, "Started") + `\s*:)`)
+	p.fileCopying = regexp.MustCompile(`^\s*(` +
+		alt(p.classes, l.Classes, "New File", "Newer", "Older", "Changed", "Modified", "Tweaked", "File") + `)\s+(\d+)\s+(.+)`)
+	p.newDir = regexp.MustCompile(`^` + alt(p.classes, l.Classes, "New Dir") + `\s+(-?\d+)\s+(.+)`)
+	p.extra = regexp.MustCompile(`^(` + alt(p.classes, l.Classes, "*EXTRA File", "*EXTRA Dir") + `)\s+(-?\d+)\s+(.+)`)
+	p.same = regexp.MustCompile(`^\s*` + alt(p.classes, l.Classes, "same") + `\s+(\d+)\s+(.+)`)
+	p.errorLine = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} ` + word(l.Error) +
+		` (\d+) \(0x[0-9A-Fa-f]+\) (.+)$`)
+
+	p.headerField = regexp.MustCompile(`^(` +
+		alt(p.fields, l.Header, "Started", "Source", "Dest", "Files", "Exc Files", "Exc Dirs", "Options") + `)\s*[:-]\s*(.*)$`)
+	p.headerError = regexp.MustCompile(`^` + word(l.Error) + ` : (.+)$`)
+	p.invalidParameter = regexp.MustCompile(`^` + word(l.InvalidParameter) + ` #(\d+) : "(.*)"`)
+
+	// : localized column headers can run into each other
+	p.summaryStart = regexp.MustCompile(`^\s*` + summary("Total") + `\s*` + summary("Copied") + `\s*` +
+		summary("Skipped") + `\s*` + summary("Mismatch") + `\s*` + summary("FAILED") + `\s*` + summary("Extras"))
+	p.dirs = regexp.MustCompile(`^\s*` + summary("Dirs") + columns)
+	p.files = regexp.MustCompile(`^\s*` + summary("Files") + columns)
+	p.bytes = regexp.MustCompile(`^\s*` + summary("Bytes") + `\s*:\s*` + strings.Repeat(number+`\s+`, 5) + number)
+	p.speedBytes = regexp.MustCompile(`^\s*` + summary("Speed") + `\s*:\s*(\d+)\s*` + summary("Bytes/sec"))
+	p.speedMB = regexp.MustCompile(`^\s*` + summary("Speed") + `\s*:\s*([0-9.,]+)\s*` + summary("MegaBytes/min"))
+	// : the total time, the first column
+	p.times = regexp.MustCompile(`^\s*` + summary("Times") + `\s*:\s*(\d+):(\d{2}):(\d{2})`)
+	p.ended = regexp.MustCompile(`^\s*` + summary("Ended") + `\s*:\s*(.+)$`)
+	patternsCache[l] = p
+	return p
+}
@@ -0,0 +1,61 @@
+package robocopy
+
+// FileEvent is emitted when robocopy starts processing a file, or lists a directory
+type FileEvent struct {
+	// Path of the file, as printed by robocopy
+	Path string
+	// Size in bytes
+	Size int64
+	// Action is the class robocopy gives the file, e.g. "New File", "Newer" or "Older", "same" for skipped files, or
+	// "*EXTRA File" and "*EXTRA Dir" for extras (whose Size is 0 for directories)
+	Action string
+}
+
+// ErrorEvent is emitted for every ERROR line robocopy prints, e.g.
+//
+//	2025/01/02 10:00:00 ERROR 5 (0x00000005) Copying File C:\src\a.txt
+//	Access is denied.
+type ErrorEvent struct {
+	// Code is the windows error code
+	Code int
+	// Action robocopy was performing, e.g. "Copying File"
+	Action string
+	// Path the action was performed on
+	Path string
+	// Message is the description of the error, printed on the line after it
+	Message string
+	// Retried is set in Stats.Errors once robocopy retries the path after this error (/R:n), i.e. prints it or its
+	// progress again. It is always false in the events passed to Observer.OnError.
+	Retried bool
+}
+
+// Observer receives events while robocopy output is parsed.
+// All methods are called from the goroutine doing the parsing, so they should return quickly.
+type Observer interface {
+	// OnFile is called when robocopy starts processing a file
+	OnFile(FileEvent)
+	// OnProgress is called with the progress of the current file, in percent
+	OnProgress(percent float32)
+	// OnDir is called for directories robocopy creates, which it only prints without /NDL
+	OnDir(FileEvent)
+	// OnExtra is called for files and directories in the destination that are not in the source, which robocopy
+	// deletes with /MIR or /PURGE
+	OnExtra(FileEvent)
+	// OnSkipped is called for files robocopy skips as unchanged ("same"), which it only prints with /V
+	OnSkipped(FileEvent)
+	// OnError is called for every error robocopy reports
+	OnError(ErrorEvent)
+	// OnSummary is called when robocopy starts printing its summary, i.e. when copying is done
+	OnSummary()
+}
+
+// NopObserver ignores all events. Embed it to implement only some methods of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnFile(FileEvent)    {}
+func (NopObserver) OnProgress(float32)  {}
+func (NopObserver) OnDir(FileEvent)     {}
+func (NopObserver) OnExtra(FileEvent)   {}
+func (NopObserver) OnSkipped(FileEvent) {}
+func (NopObserver) OnError(ErrorEvent)  {}
+func (NopObserver) OnSummary()          {}
@@ -0,0 +1,296 @@
+package robocopy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Progress of the current file, and the path at the end of an error action
+	reFileProgress = regexp.MustCompile(`(\d+\.\d+|\d+)\%`)
+	reErrorAction  = regexp.MustCompile(`^(.*?)\s+((?:[A-Za-z]:|\\\\|/).*)$`)
+)
+
+// scanLines is similar to bufio.ScanLines but also splits on \r, which robocopy uses for progress updates
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	} else if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
+		return i + 2, data[0:i], nil
+	} else if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[0:i], nil
+	} else if i := bytes.IndexByte(data, '\r'); i >= 0 {
+		return i + 1, data[0:i], nil
+	}
+
+	// If we're at EOF, we have a final, non-terminated line. Return it.
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	// Request more data.
+	return 0, nil, nil
+}
+
+// ParseStreaming parses robocopy output from r as it is being written, reporting events to obs (which can be nil)
+// and filling stats from the summary robocopy prints at the end. It stops early with the cause of ctx once it is done.
+// The language of the output is detected from its header, see ParseStreamingIn.
+func ParseStreaming(ctx context.Context, r io.Reader, stats *Stats, obs Observer) error {
+	return ParseStreamingIn(ctx, r, nil, stats, obs)
+}
+
+// ParseStreamingIn is ParseStreaming for output in lang. A nil lang detects the language from the header, falling back
+// to English without one.
+func ParseStreamingIn(ctx context.Context, r io.Reader, lang *Language, stats *Stats, obs Observer) error {
+	if obs == nil {
+		obs = NopObserver{}
+	}
+	detect := lang == nil
+	if detect {
+		lang = English
+	}
+	p := lang.patterns()
+	stats.Header.Language = lang.Name
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLines)
+	inSummary := false
+	// an error line is followed by its message, so it is only reported on the next line
+	var pendingError *ErrorEvent
+	// the header is parsed until the rule after its fields, headerList is the field that continues on the next lines
+	inHeader, headerDone := false, false
+	var headerList *[]string
+	// after a fatal error robocopy prints its usage, which is not parsed
+	fatal := false
+	// the file being copied, whose progress follows
+	var current string
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if pendingError != nil {
+			pendingError.Message = line
+			stats.Errors = append(stats.Errors, *pendingError)
+			obs.OnError(*pendingError)
+			pendingError = nil
+			continue
+		}
+
+		// Check if we're in the summary section
+		if p.summaryStart.MatchString(line) {
+			inSummary = true
+			obs.OnSummary()
+			continue
+		}
+
+		if inSummary {
+			p.parseSummaryLine(line, stats)
+			continue
+		}
+
+		if fatal {
+			continue
+		}
+		if matches := p.headerError.FindStringSubmatch(line); len(matches) > 1 {
+			stats.Header.Error = matches[1]
+			if parts := p.invalidParameter.FindStringSubmatch(matches[1]); len(parts) > 2 {
+				stats.Header.RejectedIndex, _ = strconv.Atoi(parts[1])
+				stats.Header.Rejected = parts[2]
+			}
+			fatal = true
+			continue
+		}
+
+		// # Header, absent with /NJH
+		if !headerDone && detect && !inHeader {
+			// : the language is detected from the banner, or the first field
+			for _, l := range languagesByName() {
+				if l.patterns().detect.MatchString(line) {
+					p = l.patterns()
+					stats.Header.Language = l.Name
+					break
+				}
+			}
+		}
+		if !headerDone {
+			matches := p.headerField.FindStringSubmatch(line)
+			switch {
+			case len(matches) > 2:
+				inHeader = true
+				headerList = stats.Header.field(english(p.fields, matches[1]), matches[2])
+				continue
+			case reHeaderRule.MatchString(line) || reBanner.MatchString(line):
+				headerDone = inHeader
+				continue
+			case headerList != nil:
+				*headerList = append(*headerList, line)
+				continue
+			case !inHeader:
+				headerDone = true
+			}
+		}
+
+		// # Try to detect which file is being processed
+		if matches := p.fileCopying.FindStringSubmatch(line); len(matches) > 3 {
+			current = matches[3]
+			stats.retried(current)
+			obs.OnFile(FileEvent{Path: current, Size: ParseByteValue(matches[2]), Action: english(p.classes, matches[1])})
+			continue
+		}
+
+		if matches := p.newDir.FindStringSubmatch(line); len(matches) > 2 {
+			obs.OnDir(FileEvent{Path: matches[2], Action: "New Dir"})
+			continue
+		}
+
+		if matches := p.extra.FindStringSubmatch(line); len(matches) > 3 {
+			event := FileEvent{Path: matches[3], Action: english(p.classes, matches[1])}
+			if event.Action == "*EXTRA File" {
+				event.Size = ParseByteValue(matches[2])
+			}
+			obs.OnExtra(event)
+			continue
+		}
+
+		if matches := p.same.FindStringSubmatch(line); len(matches) > 2 {
+			obs.OnSkipped(FileEvent{Path: matches[2], Size: ParseByteValue(matches[1]), Action: "same"})
+			continue
+		}
+
+		if matches := p.errorLine.FindStringSubmatch(line); len(matches) > 2 {
+			code, _ := strconv.Atoi(matches[1])
+			event := ErrorEvent{Code: code, Action: matches[2]}
+			if parts := reErrorAction.FindStringSubmatch(matches[2]); len(parts) > 2 {
+				event.Action, event.Path = parts[1], parts[2]
+			}
+			pendingError = &event
+			continue
+		}
+
+		if matches := reFileProgress.FindStringSubmatch(line); len(matches) == 2 {
+			progress, err := strconv.ParseFloat(matches[1], 32)
+			if err != nil {
+				continue
+			}
+			stats.retried(current)
+			obs.OnProgress(float32(progress))
+			continue
+		}
+	}
+	if pendingError != nil {
+		stats.Errors = append(stats.Errors, *pendingError)
+		obs.OnError(*pendingError)
+	}
+	return scanner.Err()
+}
+
+// parseSummaryLine fills stats from a line of the summary section
+func (p *patterns) parseSummaryLine(line string, stats *Stats) {
+	// Dirs
+	if matches := p.dirs.FindStringSubmatch(line); len(matches) > 6 {
+		stats.Total.Dirs, _ = strconv.Atoi(matches[1])
+		stats.Copied.Dirs, _ = strconv.Atoi(matches[2])
+		stats.Skipped.Dirs, _ = strconv.Atoi(matches[3])
+		stats.Mismatch.Dirs, _ = strconv.Atoi(matches[4])
+		stats.Failed.Dirs, _ = strconv.Atoi(matches[5])
+		stats.Extras.Dirs, _ = strconv.Atoi(matches[6])
+		return
+	}
+
+	// Files
+	if matches := p.files.FindStringSubmatch(line); len(matches) > 6 {
+		stats.Total.Files, _ = strconv.Atoi(matches[1])
+		stats.Copied.Files, _ = strconv.Atoi(matches[2])
+		stats.Skipped.Files, _ = strconv.Atoi(matches[3])
+		stats.Mismatch.Files, _ = strconv.Atoi(matches[4])
+		stats.Failed.Files, _ = strconv.Atoi(matches[5])
+		stats.Extras.Files, _ = strconv.Atoi(matches[6])
+		return
+	}
+
+	// Bytes
+	if matches := p.bytes.FindStringSubmatch(line); len(matches) > 6 {
+		stats.Total.Bytes = ParseByteValue(matches[1])
+		stats.Copied.Bytes = ParseByteValue(matches[2])
+		stats.Skipped.Bytes = ParseByteValue(matches[3])
+		stats.Mismatch.Bytes = ParseByteValue(matches[4])
+		stats.Failed.Bytes = ParseByteValue(matches[5])
+		stats.Extras.Bytes = ParseByteValue(matches[6])
+		return
+	}
+
+	// Times, total only
+	if matches := p.times.FindStringSubmatch(line); len(matches) > 3 {
+		hours, _ := strconv.Atoi(matches[1])
+		minutes, _ := strconv.Atoi(matches[2])
+		seconds, _ := strconv.Atoi(matches[3])
+		stats.Duration = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+			time.Duration(seconds)*time.Second
+		return
+	}
+
+	// Speed (Bytes/sec)
+	if matches := p.speedBytes.FindStringSubmatch(line); len(matches) > 1 {
+		stats.BytesPerSec, _ = strconv.ParseInt(matches[1], 10, 64)
+		return
+	}
+
+	// Speed (MB/min)
+	if matches := p.speedMB.FindStringSubmatch(line); len(matches) > 1 {
+		stats.MegaBytesPerMin, _ = strconv.ParseFloat(strings.ReplaceAll(matches[1], ",", "."), 64)
+		return
+	}
+
+	// Ended
+	if matches := p.ended.FindStringSubmatch(line); len(matches) > 1 {
+		stats.Ended = matches[1]
+	}
+}
+
+// ParseByteValue converts a robocopy byte value string (like "10.5 m") to bytes
+func ParseByteValue(byteStr string) int64 {
+	byteStr = strings.TrimSpace(byteStr)
+	if byteStr == "0" || byteStr == "" {
+		return 0
+	}
+
+	// Extract the number part and the unit (if any)
+	parts := strings.Fields(byteStr)
+	if len(parts) == 0 {
+		return 0
+	}
+
+	// : localized output uses decimal commas
+	value, err := strconv.ParseFloat(strings.ReplaceAll(parts[0], ",", "."), 64)
+	if err != nil {
+		return 0
+	}
+
+	// Handle units if present
+	if len(parts) > 1 {
+		unit := strings.ToLower(parts[1])
+		switch unit {
+		case "k", "kb":
+			value *= 1024
+		case "m", "mb":
+			value *= 1024 * 1024
+		case "g", "gb":
+			value *= 1024 * 1024 * 1024
+		case "t", "tb":
+			value *= 1024 * 1024 * 1024 * 1024
+		}
+	}
+
+	return int64(value)
+}
@@ -0,0 +1,190 @@
+package robocopy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingObserver collects the events of a parse
+type recordingObserver struct {
+	NopObserver
+	files, dirs, extras, skipped []FileEvent
+	errors                       []ErrorEvent
+	summaries                    int
+}
+
+func (o *recordingObserver) OnFile(e FileEvent)    { o.files = append(o.files, e) }
+func (o *recordingObserver) OnDir(e FileEvent)     { o.dirs = append(o.dirs, e) }
+func (o *recordingObserver) OnExtra(e FileEvent)   { o.extras = append(o.extras, e) }
+func (o *recordingObserver) OnSkipped(e FileEvent) { o.skipped = append(o.skipped, e) }
+func (o *recordingObserver) OnError(e ErrorEvent)  { o.errors = append(o.errors, e) }
+func (o *recordingObserver) OnSummary()            { o.summaries++ }
+
+// parseFixture parses testdata/name.txt, detecting its language
+func parseFixture(t *testing.T, name string) (Stats, *recordingObserver) {
+	t.Helper()
+	f, err := os.Open("testdata/" + name + ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var stats Stats
+	obs := &recordingObserver{}
+	if err := ParseStreamingIn(context.Background(), f, nil, &stats, obs); err != nil {
+		t.Fatalf("ParseStreamingIn: %v", err)
+	}
+	return stats, obs
+}
+
+// The fixtures are the same copy, printed by robocopy in every language
+func TestParseStreamingInLanguages(t *testing.T) {
+	tests := []struct {
+		name, started, ended string
+		// the error line of the failed file
+		errorAction, errorMessage string
+	}{
+		{"en", "Monday, January 6, 2025 10:00:00 AM", "Monday, January 6, 2025 10:00:01 AM",
+			"Copying File", "Access is denied."},
+		{"de", "Montag, 6. Januar 2025 10:00:00", "Montag, 6. Januar 2025 10:00:01",
+			"Kopieren der Datei", "Zugriff verweigert"},
+		{"fr", "lundi 6 janvier 2025 10:00:00", "lundi 6 janvier 2025 10:00:01",
+			"Copie du fichier", "Accès refusé."},
+		{"es", "lunes, 6 de enero de 2025 10:00:00", "lunes, 6 de enero de 2025 10:00:01",
+			"Copiando archivo", "Acceso denegado."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, obs := parseFixture(t, tt.name)
+
+			h := stats.Header
+			if h.Language != tt.name {
+				t.Errorf("Language = %q, want %q", h.Language, tt.name)
+			}
+			if h.Started != tt.started || h.Source != `C:\src\` || h.Dest != `D:\dst\` || h.Error != "" {
+				t.Errorf("Header = %+v", h)
+			}
+			if !slices.Equal(h.Files, []string{"*.*"}) || !slices.Equal(h.ExcludeFiles, []string{"*.tmp"}) ||
+				len(h.ExcludeDirs) != 0 {
+				t.Errorf("Header files = %v, excluded %v and %v", h.Files, h.ExcludeFiles, h.ExcludeDirs)
+			}
+			if want := []string{"/S", "/E", "/DCOPY:DA", "/COPY:DAT", "/R:2", "/W:1"}; !slices.Equal(h.Options, want) {
+				t.Errorf("Header.Options = %v, want %v", h.Options, want)
+			}
+			start, err := h.StartTime()
+			// : robocopy prints the local time
+			wantStart := time.Date(2025, time.January, 6, 10, 0, 0, 0, time.Local)
+			if err != nil || !start.Equal(wantStart) || start.Location() != time.Local {
+				t.Errorf("StartTime() = %v, %v, want %v", start, err, wantStart)
+			}
+
+			wantFiles := []FileEvent{
+				{Path: `C:\src\sub\a.txt`, Size: 1024, Action: "New File"},
+				{Path: `C:\src\b.bin`, Size: 2048, Action: "Newer"},
+				{Path: `C:\src\locked.db`, Size: 300, Action: "New File"},
+			}
+			if !reflect.DeepEqual(obs.files, wantFiles) {
+				t.Errorf("files = %+v, want %+v", obs.files, wantFiles)
+			}
+			if want := []FileEvent{{Path: `C:\src\sub\`, Action: "New Dir"}}; !reflect.DeepEqual(obs.dirs, want) {
+				t.Errorf("dirs = %+v, want %+v", obs.dirs, want)
+			}
+			if want := []FileEvent{{Path: `D:\dst\old.txt`, Size: 500, Action: "*EXTRA File"}}; !reflect.DeepEqual(obs.extras, want) {
+				t.Errorf("extras = %+v, want %+v", obs.extras, want)
+			}
+			if want := []FileEvent{{Path: `C:\src\c.dat`, Size: 4096, Action: "same"}}; !reflect.DeepEqual(obs.skipped, want) {
+				t.Errorf("skipped = %+v, want %+v", obs.skipped, want)
+			}
+			wantErrors := []ErrorEvent{{Code: 5, Action: tt.errorAction, Path: `C:\src\locked.db`, Message: tt.errorMessage}}
+			if !reflect.DeepEqual(obs.errors, wantErrors) || !reflect.DeepEqual(stats.Errors, wantErrors) {
+				t.Errorf("errors = %+v, Stats.Errors = %+v, want %+v", obs.errors, stats.Errors, wantErrors)
+			}
+			if obs.summaries != 1 {
+				t.Errorf("OnSummary called %d times, want 1", obs.summaries)
+			}
+
+			stats.Header, stats.Errors = JobHeader{}, nil
+			want := Stats{
+				Total:           FileStats{Dirs: 2, Files: 5, Bytes: 7868},
+				Copied:          FileStats{Dirs: 1, Files: 2, Bytes: 3072},
+				Skipped:         FileStats{Dirs: 1, Files: 1, Bytes: 4096},
+				Failed:          FileStats{Files: 1, Bytes: 300},
+				Extras:          FileStats{Files: 1, Bytes: 500},
+				BytesPerSec:     1024000,
+				MegaBytesPerMin: 58.593,
+				Duration:        time.Second,
+				Ended:           tt.ended,
+			}
+			if !reflect.DeepEqual(stats, want) {
+				t.Errorf("Stats = %+v, want %+v", stats, want)
+			}
+		})
+	}
+}
+
+func TestParseStreamingInInvalidParameter(t *testing.T) {
+	stats, obs := parseFixture(t, "de-invalid-parameter")
+
+	h := stats.Header
+	if h.Language != "de" || h.Source != `C:\src\` || h.Dest != `D:\dst\` {
+		t.Errorf("Header = %+v", h)
+	}
+	if h.Error != `Ungültiger Parameter #3 : "/foo"` || h.Rejected != "/foo" || h.RejectedIndex != 3 {
+		t.Errorf("Header error = %q, rejected %q (#%d)", h.Error, h.Rejected, h.RejectedIndex)
+	}
+	start, err := h.StartTime()
+	wantStart := time.Date(2025, time.January, 6, 10, 0, 0, 0, time.Local)
+	if err != nil || !start.Equal(wantStart) || start.Location() != time.Local {
+		t.Errorf("StartTime() = %v, %v, want %v", start, err, wantStart)
+	}
+
+	// : the usage robocopy prints after the error is not parsed
+	if len(obs.files)+len(obs.dirs)+len(obs.extras)+len(obs.skipped)+len(obs.errors)+obs.summaries > 0 {
+		t.Errorf("events = %+v", obs)
+	}
+	stats.Header = JobHeader{}
+	if !reflect.DeepEqual(stats, Stats{}) {
+		t.Errorf("Stats = %+v, want none", stats)
+	}
+
+	var invalid *InvalidParameterError
+	if err := h.err([]string{`C:\src`, `D:\dst`, "/foo"}); !errors.As(err, &invalid) {
+		t.Fatalf("err() = %v, want an InvalidParameterError", err)
+	}
+	if invalid.Param != "/foo" || invalid.Position() != 2 {
+		t.Errorf("InvalidParameterError = %+v, position %d", invalid, invalid.Position())
+	}
+}
+
+// With /R:n robocopy prints a file again after an error when it retries it
+func TestFailedPathsRetried(t *testing.T) {
+	output := "\t    New File  \t\t        1024\tC:\\src\\a.txt\r\n" +
+		"2025/01/06 10:00:00 ERROR 32 (0x00000020) Copying File C:\\src\\a.txt\r\n" +
+		"The process cannot access the file because it is being used by another process.\r\n" +
+		"Waiting 1 seconds... Retrying...\r\n" +
+		"\t    New File  \t\t        1024\tC:\\src\\a.txt\r\n" +
+		"  0%  \r100%  \r\n" +
+		"\t    New File  \t\t         300\tC:\\src\\locked.db\r\n" +
+		"2025/01/06 10:00:01 ERROR 5 (0x00000005) Copying File C:\\src\\locked.db\r\n" +
+		"Access is denied.\r\n" +
+		"Waiting 1 seconds... Retrying...\r\n" +
+		"\t    New File  \t\t         300\tC:\\src\\locked.db\r\n" +
+		"2025/01/06 10:00:02 ERROR 5 (0x00000005) Copying File C:\\src\\locked.db\r\n" +
+		"Access is denied.\r\n" +
+		"ERROR: RETRY LIMIT EXCEEDED.\r\n"
+	var stats Stats
+	if err := ParseStreaming(context.Background(), strings.NewReader(output), &stats, nil); err != nil {
+		t.Fatalf("ParseStreaming: %v", err)
+	}
+	if len(stats.Errors) != 3 || !stats.Errors[0].Retried || !stats.Errors[1].Retried || stats.Errors[2].Retried {
+		t.Errorf("Errors = %+v, want the first two retried", stats.Errors)
+	}
+	if got, want := stats.FailedPaths(), []string{`C:\src\locked.db`}; !slices.Equal(got, want) {
+		t.Errorf("FailedPaths() = %v, want %v", got, want)
+	}
+}
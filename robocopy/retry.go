@@ -0,0 +1,92 @@
+package robocopy
+
+import (
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxFilesPerJob is the number of files in a directory above which Retry copies the whole directory instead, to keep the
+// command line short. robocopy skips the files that were already copied.
+const maxFilesPerJob = 64
+
+// recursiveFlags are dropped from the jobs retrying single files, where they would copy (or purge) more than the files
+var recursiveFlags = []string{"/mir", "/e", "/s", "/purge"}
+
+// Retry returns the jobs that re-run only the given failed paths (see Stats.FailedPaths), one per directory since
+// robocopy only takes file names relative to a single source directory (see maxFilesPerJob). Failed directories
+// (paths ending with a separator) are re-run as a whole with the options of j. Paths that are not inside the source of
+// j are returned as unmatched, including the ones in the destination (e.g. a failed delete of an extra file), which
+// have no source to copy from.
+func (j Job) Retry(paths []string) (jobs []Job, unmatched []string, err error) {
+	// : robocopy reports absolute paths
+	root, err := j.AbsRoot()
+	if err != nil {
+		return nil, nil, err
+	}
+	dest, err := j.AbsDest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileOptions := j.Options
+	fileOptions.Mirror = false
+	fileOptions.Extra = slices.DeleteFunc(slices.Clone(j.Options.Extra), func(e string) bool {
+		return slices.Contains(recursiveFlags, strings.ToLower(e))
+	})
+
+	// : failed files grouped by their directory relative to root
+	files := make(map[string][]string)
+	for _, p := range paths {
+		rel, ok := RelPath(root, p)
+		if !ok {
+			unmatched = append(unmatched, p)
+			continue
+		}
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			jobs = append(jobs, Job{Sources: []string{root + rel}, Dest: dest + rel, Options: j.Options, StallTimeout: j.StallTimeout,
+				Language: j.Language, Encoding: j.Encoding, Recorder: j.Recorder})
+			continue
+		}
+		dir, name := path.Split(rel)
+		if !slices.Contains(files[dir], name) {
+			files[dir] = append(files[dir], name)
+		}
+	}
+
+	dirs := make([]string, 0, len(files))
+	for dir := range files {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		sources := make([]string, 0, len(files[dir]))
+		for _, name := range files[dir] {
+			sources = append(sources, root+dir+name)
+		}
+		if len(sources) > maxFilesPerJob {
+			sources = []string{root + dir}
+		}
+		jobs = append(jobs, Job{Sources: sources, Dest: dest + dir, Options: fileOptions, StallTimeout: j.StallTimeout,
+			Language: j.Language, Encoding: j.Encoding, Recorder: j.Recorder})
+	}
+	return jobs, unmatched, nil
+}
+
+// withSlash converts p to forward slashes and ensures it ends with one
+func withSlash(p string) string {
+	p = filepath.ToSlash(p)
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case, as windows paths are case-insensitive
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
@@ -0,0 +1,120 @@
+// Package robocopy runs robocopy and parses its output into structured events and statistics.
+// It holds no global state, so multiple jobs can run concurrently in one process.
+package robocopy
+
+import "time"
+
+// FileStats represents statistics for a category of files
+type FileStats struct {
+	Dirs  int
+	Files int
+	Bytes int64
+}
+
+// Stats represents all statistics from a robocopy operation
+type Stats struct {
+	// Categories of statistics
+	Total    FileStats
+	Copied   FileStats
+	Skipped  FileStats
+	Mismatch FileStats
+	Failed   FileStats
+	Extras   FileStats
+
+	// Speed information
+	BytesPerSec     int64
+	MegaBytesPerMin float64
+
+	// Duration of the run, measured when running robocopy and from its Times row when only parsing its output
+	Duration time.Duration
+	// Ended is when robocopy finished, as printed by robocopy, see ParseTime
+	Ended string
+
+	// Exit code
+	ExitCode int
+
+	// Errors reported while copying, in order. The same path can appear several times as robocopy retries it.
+	Errors []ErrorEvent
+
+	// Header robocopy printed before copying
+	Header JobHeader
+}
+
+// FailedPaths returns the distinct paths of Errors whose last attempt failed, in the order they first failed. A path
+// robocopy retried successfully after an error is not failed.
+func (s Stats) FailedPaths() []string {
+	failed := make(map[string]bool)
+	order := make([]string, 0)
+	for _, e := range s.Errors {
+		if e.Path == "" {
+			continue
+		}
+		if _, ok := failed[e.Path]; !ok {
+			order = append(order, e.Path)
+		}
+		failed[e.Path] = !e.Retried
+	}
+	paths := make([]string, 0)
+	for _, path := range order {
+		if failed[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// retried marks the last error as retried if it is for path, which robocopy prints again (or the progress of) when
+// it retries it: the retry comes right after the error, and the error ends with RETRY LIMIT EXCEEDED otherwise.
+func (s *Stats) retried(path string) {
+	if n := len(s.Errors); n > 0 && s.Errors[n-1].Path == path {
+		s.Errors[n-1].Retried = true
+	}
+}
+
+func (f *FileStats) add(o FileStats) {
+	f.Dirs += o.Dirs
+	f.Files += o.Files
+	f.Bytes += o.Bytes
+}
+
+// Add sums the statistics of another run into s, e.g. to combine jobs run one after the other
+func (s *Stats) Add(o Stats) {
+	s.Total.add(o.Total)
+	s.Copied.add(o.Copied)
+	s.Skipped.add(o.Skipped)
+	s.Mismatch.add(o.Mismatch)
+	s.Failed.add(o.Failed)
+	s.Extras.add(o.Extras)
+	s.Duration += o.Duration
+	// : exit codes are bit flags
+	s.ExitCode |= o.ExitCode
+	s.Errors = append(s.Errors, o.Errors...)
+	// : the header of the first run
+	if s.Header.Started == "" {
+		s.Header = o.Header
+	}
+	if o.Ended != "" {
+		s.Ended = o.Ended
+	}
+	s.updateSpeed()
+}
+
+// MergeRetry merges the statistics of a retry of the failed files into s: the files it copied are added, and what
+// still failed replaces the failures (and errors) of s.
+func (s *Stats) MergeRetry(retry Stats) {
+	s.Copied.add(retry.Copied)
+	s.Failed = retry.Failed
+	s.Duration += retry.Duration
+	s.ExitCode = s.ExitCode&^(8|16) | retry.ExitCode&(1|8|16)
+	s.Errors = retry.Errors
+	s.updateSpeed()
+}
+
+// updateSpeed recomputes the speeds from the copied bytes and the duration
+func (s *Stats) updateSpeed() {
+	if s.Duration <= 0 {
+		return
+	}
+	s.BytesPerSec = int64(float64(s.Copied.Bytes) / s.Duration.Seconds())
+	s.MegaBytesPerMin = float64(s.BytesPerSec) * 60 / 1024 / 1024
+}
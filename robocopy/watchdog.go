@@ -0,0 +1,156 @@
+package robocopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrStalled is the cause of a run being stopped because robocopy printed nothing for Job.StallTimeout
+var ErrStalled = errors.New("robocopy stalled")
+
+// StoppedError is returned by Run when robocopy was killed before finishing, because ctx was cancelled, its deadline
+// passed or robocopy stalled. It describes what was in flight at that point.
+type StoppedError struct {
+	// Cause is context.Canceled, context.DeadlineExceeded or ErrStalled (or the cause given to a context.CancelCauseFunc)
+	Cause error
+	// File is the file robocopy was processing, empty if it had not started on one
+	File FileEvent
+	// Progress of File in percent
+	Progress float32
+	// Idle is how long before being stopped robocopy last printed anything
+	Idle time.Duration
+}
+
+func (e *StoppedError) Error() string {
+	msg := e.Cause.Error()
+	if e.File.Path != "" {
+		msg += fmt.Sprintf(" while copying %v (%.f%%)", e.File.Path, e.Progress)
+	}
+	return msg + fmt.Sprintf(", last output %v ago", e.Idle.Round(time.Second))
+}
+
+func (e *StoppedError) Unwrap() error {
+	return e.Cause
+}
+
+// watchdog forwards events to an Observer, keeping track of the file in flight and of when the last event was seen
+type watchdog struct {
+	obs Observer
+
+	mu       sync.Mutex
+	file     FileEvent
+	progress float32
+	last     time.Time
+}
+
+func newWatchdog(obs Observer) *watchdog {
+	if obs == nil {
+		obs = NopObserver{}
+	}
+	return &watchdog{obs: obs, last: time.Now()}
+}
+
+func (w *watchdog) OnFile(e FileEvent) {
+	w.mu.Lock()
+	w.file, w.progress, w.last = e, 0, time.Now()
+	w.mu.Unlock()
+	w.obs.OnFile(e)
+}
+
+func (w *watchdog) OnProgress(percent float32) {
+	w.mu.Lock()
+	w.progress, w.last = percent, time.Now()
+	w.mu.Unlock()
+	w.obs.OnProgress(percent)
+}
+
+func (w *watchdog) OnDir(e FileEvent) {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	w.obs.OnDir(e)
+}
+
+func (w *watchdog) OnExtra(e FileEvent) {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	w.obs.OnExtra(e)
+}
+
+func (w *watchdog) OnSkipped(e FileEvent) {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	w.obs.OnSkipped(e)
+}
+
+func (w *watchdog) OnError(e ErrorEvent) {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	w.obs.OnError(e)
+}
+
+func (w *watchdog) OnSummary() {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	w.obs.OnSummary()
+}
+
+// reader returns r, which also counts as an event whenever robocopy prints anything: it prints directories that
+// exist without any label, so a pass over a tree that is in sync can go without events for a long time
+func (w *watchdog) reader(r io.Reader) io.Reader {
+	return watchedReader{r, w}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (r watchedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.mu.Lock()
+		r.w.last = time.Now()
+		r.w.mu.Unlock()
+	}
+	return n, err
+}
+
+// idle returns how long ago the last event was seen
+func (w *watchdog) idle() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.last)
+}
+
+// watch cancels ctx with ErrStalled once no event has been seen for timeout. It returns when ctx is done.
+func (w *watchdog) watch(ctx context.Context, cancel context.CancelCauseFunc, timeout time.Duration) {
+	ticker := time.NewTicker(max(min(timeout/10, time.Second), time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.idle() >= timeout {
+				cancel(ErrStalled)
+				return
+			}
+		}
+	}
+}
+
+// stopped builds the StoppedError for a run stopped with the given cause
+func (w *watchdog) stopped(cause error) *StoppedError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return &StoppedError{Cause: cause, File: w.file, Progress: w.progress, Idle: time.Since(w.last)}
+}
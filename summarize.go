@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+	"golang.org/x/text/encoding"
+
+	"rbcp/robocopy"
+)
+
+// # rbcp summarize
+// summarize parses robocopy logs saved with /LOG or /UNILOG as rbcp parses the output of a copy, without running
+// robocopy. Logs appended to with /LOG+ hold one run per header. Robocopy does not log its exit code, so it is worked
+// out from the summary of each run.
+
+type SummarizeCmd struct {
+	CommonFlags
+	Logs      []string `arg:"positional,required" placeholder:"LOG" help:"robocopy log files"`
+	JSON      bool     `arg:"--json" help:"print the summaries as JSON"`
+	Aggregate bool     `arg:"-a,--aggregate" help:"aggregate the runs by day: bytes copied and failure rates"`
+}
+
+func (SummarizeCmd) Description() string {
+	return "Summarize saved robocopy logs, as rbcp reports a copy.\n"
+}
+
+// reRunStart matches the rule above the banner that starts every run of robocopy in a log
+var reRunStart = regexp.MustCompile(`(?m)^-{20,}\r?\n\s*ROBOCOPY\s+::`)
+
+// LogSummary is a single run of robocopy in a log
+type LogSummary struct {
+	Log string `json:"log"`
+	// Run is the number of the run in the log, from 1
+	Run int `json:"run"`
+	// Started is when robocopy started, nil if it could not be parsed
+	Started  *time.Time `json:"started,omitempty"`
+	Source   string     `json:"source"`
+	Dest     string     `json:"dest"`
+	Language string     `json:"language"`
+	// Complete is false for runs without a summary, e.g. interrupted ones
+	Complete bool      `json:"complete"`
+	ExitCode int       `json:"exit_code"`
+	Duration float64   `json:"duration_seconds"`
+	Total    planTotal `json:"total"`
+	Copied   planTotal `json:"copied"`
+	Skipped  planTotal `json:"skipped"`
+	Mismatch planTotal `json:"mismatch"`
+	Failed   planTotal `json:"failed"`
+	Extras   planTotal `json:"extras"`
+	// Error is the fatal error robocopy logged instead of copying
+	Error       string   `json:"error,omitempty"`
+	FailedPaths []string `json:"failed_paths"`
+
+	stats robocopy.Stats
+	// runs is the number of runs in the log
+	runs int
+}
+
+// DaySummary aggregates the runs started on the same day
+type DaySummary struct {
+	// Day is formatted as 2006-01-02, unknown for runs whose start could not be parsed
+	Day        string    `json:"day"`
+	Runs       int       `json:"runs"`
+	FailedRuns int       `json:"failed_runs"`
+	Copied     planTotal `json:"copied"`
+	Failed     planTotal `json:"failed"`
+	// FailureRate is the share of runs that failed (exit code 8 or more), FileFailureRate the share of files that
+	// could not be copied
+	FailureRate     float64 `json:"failure_rate"`
+	FileFailureRate float64 `json:"file_failure_rate"`
+}
+
+func (d *DaySummary) add(s LogSummary) {
+	d.Runs++
+	if s.ExitCode >= 8 {
+		d.FailedRuns++
+	}
+	d.Copied.add(s.Copied)
+	d.Failed.add(s.Failed)
+	d.FailureRate = float64(d.FailedRuns) / float64(d.Runs)
+	if files := d.Copied.Files + d.Failed.Files; files > 0 {
+		d.FileFailureRate = float64(d.Failed.Files) / float64(files)
+	}
+}
+
+func (t *planTotal) add(o planTotal) {
+	t.Files += o.Files
+	t.Dirs += o.Dirs
+	t.Bytes += o.Bytes
+}
+
+func totalOf(f robocopy.FileStats) planTotal {
+	return planTotal{Files: f.Files, Dirs: f.Dirs, Bytes: f.Bytes}
+}
+
+func runSummarizeCmd(argv []string) {
+	var cmd SummarizeCmd
+	parseSubcommand("summarize", argv, &cmd)
+	args.CommonFlags = cmd.CommonFlags
+	setup()
+
+	lang, err := robocopy.LookupLanguage(config.RobocopyLanguage)
+	if err != nil {
+		logger.Fatalf("Invalid robocopy_language: %v", err)
+	}
+	enc, err := robocopy.LookupEncoding(config.RobocopyEncoding)
+	if err != nil {
+		logger.Fatalf("Invalid robocopy_encoding: %v", err)
+	}
+	summaries := make([]LogSummary, 0, len(cmd.Logs))
+	unreadable := false
+	for _, path := range cmd.Logs {
+		runs, err := summarizeLog(path, lang, enc)
+		if err != nil {
+			logger.Errorf("Cannot read %v: %v", path, err)
+			unreadable = true
+			continue
+		}
+		summaries = append(summaries, runs...)
+	}
+
+	switch {
+	case cmd.Aggregate:
+		days, total := aggregateByDay(summaries)
+		if cmd.JSON {
+			writeJSON(struct {
+				Days  []DaySummary `json:"days"`
+				Total DaySummary   `json:"total"`
+			}{days, total})
+		} else {
+			displayDays(days, total)
+		}
+	case cmd.JSON:
+		writeJSON(summaries)
+	default:
+		for i, s := range summaries {
+			if i > 0 {
+				fmt.Println()
+			}
+			displayLogSummary(s)
+		}
+	}
+
+	code := 0
+	for _, s := range summaries {
+		code |= s.ExitCode
+	}
+	switch {
+	case unreadable:
+		os.Exit(16)
+	case code >= 8:
+		os.Exit(code)
+	}
+}
+
+// summarizeLog parses every run of robocopy in the log at path
+func summarizeLog(path string, lang *robocopy.Language, enc encoding.Encoding) ([]LogSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(robocopy.Decode(f, enc))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// : the output before the first header is a run too, e.g. for logs of /NJH runs
+	starts := []int{0}
+	for _, loc := range reRunStart.FindAllIndex(data, -1) {
+		if loc[0] > 0 {
+			starts = append(starts, loc[0])
+		}
+	}
+	// : logs start with an empty line, before the first header
+	runs := make([][]byte, 0, len(starts))
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		if len(bytes.TrimSpace(data[start:end])) > 0 {
+			runs = append(runs, data[start:end])
+		}
+	}
+	summaries := make([]LogSummary, 0, len(runs))
+	for _, run := range runs {
+		var stats robocopy.Stats
+		obs := summaryObserver{Observer: robocopy.NopObserver{}}
+		if err := robocopy.ParseStreamingIn(context.Background(), bytes.NewReader(run), lang, &stats, &obs); err != nil {
+			return nil, err
+		}
+		if stats.Header.Started == "" && stats.Header.Error == "" && !obs.done {
+			logger.Warnf("%v: skipping output that is neither a robocopy header nor a summary", path)
+			continue
+		}
+		s := LogSummary{Log: path, Run: len(summaries) + 1, Source: stats.Header.Source, Dest: stats.Header.Dest,
+			Language: stats.Header.Language, Complete: obs.done, ExitCode: logExitCode(stats),
+			Duration: stats.Duration.Seconds(), Total: totalOf(stats.Total), Copied: totalOf(stats.Copied),
+			Skipped: totalOf(stats.Skipped), Mismatch: totalOf(stats.Mismatch), Failed: totalOf(stats.Failed),
+			Extras: totalOf(stats.Extras), Error: stats.Header.Error, FailedPaths: stats.FailedPaths(), stats: stats}
+		if started, err := stats.Header.StartTime(); err == nil {
+			s.Started = &started
+		} else if len(runs) == 1 {
+			// : a log holding a single run was last written when it ended
+			modified := info.ModTime()
+			s.Started = &modified
+			logger.Debugf("%v: %v, using the modification time of the log", path, err)
+		}
+		summaries = append(summaries, s)
+	}
+	for i := range summaries {
+		summaries[i].runs = len(summaries)
+	}
+	return summaries, nil
+}
+
+// summaryObserver records whether robocopy printed its summary, forwarding all events to Observer
+type summaryObserver struct {
+	robocopy.Observer
+	done bool
+}
+
+func (o *summaryObserver) OnSummary() {
+	o.done = true
+	o.Observer.OnSummary()
+}
+
+// logExitCode works out the exit code of a run from its summary, as robocopy sets its bits
+func logExitCode(stats robocopy.Stats) int {
+	if stats.Header.Error != "" {
+		return 16
+	}
+	code := 0
+	if stats.Copied.Files > 0 {
+		code |= 1
+	}
+	if stats.Extras.Files+stats.Extras.Dirs > 0 {
+		code |= 2
+	}
+	if stats.Mismatch.Files+stats.Mismatch.Dirs > 0 {
+		code |= 4
+	}
+	if stats.Failed.Files+stats.Failed.Dirs > 0 {
+		code |= 8
+	}
+	return code
+}
+
+// aggregateByDay sums the runs by the day they started, sorted by day with runs of unknown days last
+func aggregateByDay(summaries []LogSummary) ([]DaySummary, DaySummary) {
+	byDay := make(map[string]*DaySummary)
+	total := DaySummary{Day: "total"}
+	for _, s := range summaries {
+		day := "unknown"
+		if s.Started != nil {
+			day = s.Started.Format(time.DateOnly)
+		}
+		if byDay[day] == nil {
+			byDay[day] = &DaySummary{Day: day}
+		}
+		byDay[day].add(s)
+		total.add(s)
+	}
+	days := make([]DaySummary, 0, len(byDay))
+	for _, d := range byDay {
+		days = append(days, *d)
+	}
+	slices.SortFunc(days, func(a, b DaySummary) int {
+		if (a.Day == "unknown") != (b.Day == "unknown") {
+			if a.Day == "unknown" {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Day, b.Day)
+	})
+	return days, total
+}
+
+// displayLogSummary prints a run like the summary of a copy, followed by the files that failed
+func displayLogSummary(s LogSummary) {
+	title := pathStyle.Render(s.Log)
+	if s.runs > 1 {
+		title += helpStyle.Render(fmt.Sprintf(" run %d of %d", s.Run, s.runs))
+	}
+	if s.stats.Header.Started != "" {
+		title += helpStyle.Render(" started " + s.stats.Header.Started)
+	}
+	fmt.Println(title)
+	if s.Source != "" || s.Dest != "" {
+		fmt.Println(pathStyle.Render(s.Source) + headerArrow() + pathStyle.Render(s.Dest))
+	}
+	if s.Error != "" {
+		fmt.Println(errorStyle.Render("Robocopy copied nothing: ") + s.Error)
+		return
+	}
+	if !s.Complete {
+		fmt.Println(errorStyle.Render("No summary, robocopy did not finish this run"))
+	}
+	s.stats.ExitCode = s.ExitCode
+	displaySummary(s.stats, nil)
+	if len(s.FailedPaths) > 0 {
+		fmt.Println(errorStyle.Render("Failed:"))
+	}
+	for _, path := range s.FailedPaths {
+		// : the last error of a path is the one it failed with, after the retries
+		var last robocopy.ErrorEvent
+		for _, e := range s.stats.Errors {
+			if e.Path == path {
+				last = e
+			}
+		}
+		fmt.Printf("  %v %v: %v (error %d)\n", errorStyle.Render("✗"), path, last.Message, last.Code)
+	}
+}
+
+// displayDays prints the runs aggregated by day as a table
+func displayDays(days []DaySummary, total DaySummary) {
+	rows := append(slices.Clone(days), total)
+	t := table.New().
+		Border(lipgloss.RoundedBorder()).
+		BorderStyle(helpStyle).
+		Headers("DAY", "RUNS", "FAILED RUNS", "COPIED", "BYTES", "FAILED FILES", "FILE FAILURES").
+		StyleFunc(func(row, col int) lipgloss.Style {
+			style := lipgloss.NewStyle().Padding(0, 1)
+			if row == table.HeaderRow {
+				return style.Bold(true)
+			}
+			if row == len(rows)-1 {
+				style = style.Bold(true)
+			}
+			if col > 0 {
+				style = style.Align(lipgloss.Right)
+			}
+			if (col == 2 || col == 5 || col == 6) && rows[row].FailedRuns > 0 {
+				return style.Inherit(errorStyle)
+			}
+			return style
+		})
+	for _, d := range rows {
+		t.Row(d.Day, strconv.Itoa(d.Runs), fmt.Sprintf("%d (%.1f%%)", d.FailedRuns, d.FailureRate*100),
+			strconv.Itoa(d.Copied.Files), formatByteValue(d.Copied.Bytes), strconv.Itoa(d.Failed.Files),
+			fmt.Sprintf("%.2f%%", d.FileFailureRate*100))
+	}
+	fmt.Println(t)
+}
+
+// writeJSON prints v as indented JSON
+func writeJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logger.Fatalf("could not encode JSON: %v", err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
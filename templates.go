@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+
+	"rbcp/robocopy"
+)
+
+// defaultStatusTemplate renders the TUI below the robocopy header: byte counters, progress bar and the status line
+const defaultStatusTemplate = `
+{{- fixed (bytes .CopiedBytes) }}/{{ fixed (bytes .TotalBytes) }}
+{{- if .Bar }} {{ .Bar }} {{ "\n" }}{{ end -}}
+{{ " " }}
+{{- $status := printf "Currently copying %s [%.f%% of %s]" .CurrentFile .FileProgress (bytes .FileSize) -}}
+{{- if .Threads }}{{ $status = printf "%d threads, files completing" .Threads }}{{ end -}}
+{{- if .Verifying }}{{ $status = printf "Hashed %s" .CurrentFile }}{{ end -}}
+{{- if .Finished }}{{ $status = "Copying completed" }}{{ if .Verifying }}{{ $status = "Hashing completed" }}{{ end }}{{ end -}}
+{{ justify .Width (style "neutral" $status) (printf "%d/%d" .CopiedFiles .TotalFiles) }} {{ "\n" }}
+{{- if not .Finished }}{{ range .Completing }}
+{{- style "neutral" (truncate $.Width (printf "   %s [%s]" .Path (bytes .Size))) }}{{ "\n" }}
+{{- end }}{{ end }}`
+
+// defaultSummaryTemplate renders the report printed after robocopy exits
+const defaultSummaryTemplate = `
+{{- /* because skipped files are not errors */ -}}
+{{- if eq .Skipped.Bytes 0 -}}
+Copied {{ style "primary" (printf "%d files" .Copied.Files) }} over {{ style "primary" (printf "%d directories" .Copied.Dirs) }}
+       {{ style "primary" (bytes .Copied.Bytes) }} in {{ style "primary" (printf "%s seconds" (seconds .Duration)) }} [{{ style "neutral" (bytes .BytesPerSec) }}/s]
+{{ else -}}
+Copied {{ style "primary" (printf "%d files" .Copied.Files) }} ({{ style "neutral" (print .Skipped.Files) }} skipped) over {{ style "primary" (printf "%d directories" .Copied.Dirs) }} ({{ style "neutral" (print .Skipped.Dirs) }} skipped)
+       {{ style "primary" (bytes .Copied.Bytes) }} ({{ style "neutral" (bytes .Skipped.Bytes) }} skipped) in {{ style "primary" (printf "%s seconds" (seconds .Duration)) }} [{{ style "neutral" (bytes .BytesPerSec) }}/s]
+{{ end -}}
+{{ if gt .Mismatch.Files 0 }}Mismatched files: {{ .Mismatch.Files }}
+{{ end -}}
+{{ if gt .Failed.Files 0 }}Failed files: {{ .Failed.Files }}
+{{ end -}}
+{{ if gt .Extras.Files 0 }}Extra files: {{ .Extras.Files }}
+{{ end -}}
+{{ range .Attempts }}  Attempt {{ .Attempt }}: {{ style "primary" (printf "%d copied" .Copied.Files) }}, {{ if gt .Failed.Files 0 }}{{ style "error" (printf "%d failed" .Failed.Files) }}{{ else }}0 failed{{ end }} in {{ duration .Duration }} (exit code {{ .ExitCode }})
+{{ end -}}
+{{ with .Verified }}Verified {{ style "primary" (printf "%d files" .Files) }}{{ if lt .Files .Total }} of {{ .Total }}{{ end }} ({{ bytes .Bytes }}, {{ .Algorithm }}){{ if .Mismatches }}: {{ style "error" (printf "%d mismatched" (len .Mismatches)) }}{{ end }}
+{{ range .Mismatches }}  {{ style "error" "✗" }} {{ .Path }}: {{ .Reason }}
+{{ end }}{{ end -}}
+{{ if gt .ExitCode 8 }}{{ style "error" (printf "Exit code: %d" .ExitCode) }}{{ else }}Exit code: {{ .ExitCode }}{{ end }}
+{{ range exitcodes .ExitCode }}{{ . }}
+{{ end -}}`
+
+var (
+	statusTemplate  *template.Template
+	summaryTemplate *template.Template
+)
+
+// statusData is what the status template is executed with
+type statusData struct {
+	CopiedBytes int64
+	TotalBytes  int64
+	CopiedFiles int
+	TotalFiles  int
+	// CurrentFile is the file being copied, FileSize its size and FileProgress its progress in percent
+	CurrentFile  string
+	FileSize     int64
+	FileProgress float32
+	// Percent is the overall progress, from 0 to 1
+	Percent float64
+	// Speed is the average speed in bytes/sec
+	Speed   int64
+	ETA     time.Duration
+	Elapsed time.Duration
+	// Finished is set once robocopy has printed its summary
+	Finished bool
+	// Verifying is set in the phase hashing files (--verify, --manifest or rbcp check), where the counters are the
+	// files and bytes hashed
+	Verifying bool
+	// Threads robocopy copies with /MT, 0 without it. Robocopy then shows no progress per file, CurrentFile is the last
+	// file completed and Completing the last few (each with Path and Size).
+	Threads    int
+	Completing []completedFile
+	// Bar is the rendered progress bar, empty if ShowProgress is disabled
+	Bar string
+	// Width is the width available for a single line
+	Width int
+}
+
+// summaryData is what the summary template is executed with
+type summaryData struct {
+	robocopy.Stats
+	// Attempts are the stats of every run with --retry-job, empty if robocopy was only run once
+	Attempts []attemptData
+	// Verified is the result of --verify, nil without it
+	Verified *verifyResult
+}
+
+type attemptData struct {
+	// Attempt is the number of the run, starting at 1
+	Attempt int
+	robocopy.Stats
+}
+
+// templateStyles maps the names usable with the style template func to their styles
+func templateStyles() map[string]lipgloss.Style {
+	return map[string]lipgloss.Style{
+		"neutral":   helpStyle,
+		"primary":   impStyle,
+		"secondary": pathStyle,
+		"error":     errorStyle,
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes": formatByteValue,
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"seconds": func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', 2, 64)
+	},
+	// style renders texts (joined by spaces) with one of the theme styles: neutral, primary, secondary or error
+	"style": func(name string, texts ...string) string {
+		style, ok := templateStyles()[name]
+		if !ok {
+			return strings.Join(texts, " ")
+		}
+		return style.Render(texts...)
+	},
+	"fixed": func(s string) string {
+		return fixedWidth.Render(s)
+	},
+	"justify": JustifyText,
+	// truncate cuts s to width cells, ending with an ellipsis
+	"truncate": func(width int, s string) string {
+		return ansi.Truncate(s, max(width, 0), "…")
+	},
+	"exitcodes": explainExitCode,
+}
+
+// parseTemplates parses the status and summary templates from the config, falling back to the default ones if unset
+func parseTemplates(conf Config) (status *template.Template, summary *template.Template, err error) {
+	statusText := conf.StatusTemplate
+	if statusText == "" {
+		statusText = defaultStatusTemplate
+	}
+	summaryText := conf.SummaryTemplate
+	if summaryText == "" {
+		summaryText = defaultSummaryTemplate
+	}
+	status, err = template.New("status_template").Funcs(templateFuncs).Parse(statusText)
+	if err != nil {
+		return nil, nil, err
+	}
+	summary, err = template.New("summary_template").Funcs(templateFuncs).Parse(summaryText)
+	return status, summary, err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// Color is a theme color. Either a single color, or a pair adapting to the terminal background,
+// written as { Light = "#...", Dark = "#..." } in the config.
+type Color struct {
+	Light string
+	Dark  string
+}
+
+// solid returns a Color that is the same on light and dark backgrounds
+func solid(c string) Color {
+	return Color{c, c}
+}
+
+func (c *Color) UnmarshalTOML(data any) error {
+	switch data := data.(type) {
+	case string:
+		*c = solid(data)
+	case int64:
+		// : ANSI colors can be given without quotes
+		*c = solid(strconv.FormatInt(data, 10))
+	case map[string]any:
+		for key, value := range data {
+			var v Color
+			if err := v.UnmarshalTOML(value); err != nil {
+				return err
+			}
+			switch strings.ToLower(key) {
+			case "light":
+				c.Light = v.Light
+			case "dark":
+				c.Dark = v.Dark
+			default:
+				return fmt.Errorf("unknown color key %q, expected light or dark", key)
+			}
+		}
+	default:
+		return fmt.Errorf("color must be a string or a { Light, Dark } table, got %T", data)
+	}
+	return nil
+}
+
+func (c Color) MarshalTOML() ([]byte, error) {
+	if c.Light == c.Dark {
+		return []byte(strconv.Quote(c.Dark)), nil
+	}
+	return []byte(fmt.Sprintf("{ Light = %s, Dark = %s }", strconv.Quote(c.Light), strconv.Quote(c.Dark))), nil
+}
+
+// terminal returns the color for use in lipgloss styles
+func (c Color) terminal() lipgloss.TerminalColor {
+	if c.Light == c.Dark {
+		return lipgloss.Color(c.Dark)
+	}
+	return lipgloss.AdaptiveColor{Light: c.Light, Dark: c.Dark}
+}
+
+// resolve returns the single color matching the terminal background, for places that need a plain string
+func (c Color) resolve() string {
+	if lipgloss.HasDarkBackground() {
+		return c.Dark
+	}
+	return c.Light
+}
+
+type Theme struct {
+	// Name of the built-in theme the colors are based on
+	Name           string
+	ColorNeutral   Color
+	ColorPrimary   Color
+	ColorSecondary Color
+	ColorError     Color
+	ColorProgress  [2]Color
+}
+
+var builtinThemes = map[string]Theme{
+	"default": {
+		Name:           "default",
+		ColorNeutral:   solid("#626262"),
+		ColorPrimary:   solid("#5956E0"),
+		ColorSecondary: Color{Light: "#5A6BB5", Dark: "#ADBDFF"},
+		ColorError:     solid("#DA4167"),
+		ColorProgress:  [2]Color{solid("#5956E0"), solid("#EE6FF8")},
+	},
+	"dracula": {
+		Name:           "dracula",
+		ColorNeutral:   Color{Light: "#6C664B", Dark: "#6272A4"},
+		ColorPrimary:   Color{Light: "#644AC9", Dark: "#BD93F9"},
+		ColorSecondary: Color{Light: "#036A96", Dark: "#8BE9FD"},
+		ColorError:     Color{Light: "#CB3A2A", Dark: "#FF5555"},
+		ColorProgress:  [2]Color{{Light: "#644AC9", Dark: "#BD93F9"}, {Light: "#A3144D", Dark: "#FF79C6"}},
+	},
+	"high-contrast": {
+		Name:           "high-contrast",
+		ColorNeutral:   Color{Light: "#303030", Dark: "#D0D0D0"},
+		ColorPrimary:   Color{Light: "#0000D7", Dark: "#FFFF00"},
+		ColorSecondary: Color{Light: "#005F00", Dark: "#00FFFF"},
+		ColorError:     Color{Light: "#D70000", Dark: "#FF5F5F"},
+		ColorProgress:  [2]Color{{Light: "#0000D7", Dark: "#FFFF00"}, {Light: "#0000D7", Dark: "#FFFF00"}},
+	},
+	"mono": {
+		Name:           "mono",
+		ColorNeutral:   solid("#808080"),
+		ColorPrimary:   Color{Light: "#000000", Dark: "#FFFFFF"},
+		ColorSecondary: Color{Light: "#3A3A3A", Dark: "#D0D0D0"},
+		ColorError:     Color{Light: "#000000", Dark: "#FFFFFF"},
+		ColorProgress:  [2]Color{{Light: "#3A3A3A", Dark: "#808080"}, {Light: "#000000", Dark: "#FFFFFF"}},
+	},
+}
+
+// themeNames returns the names of the built-in themes, sorted
+func themeNames() []string {
+	names := make([]string, 0, len(builtinThemes))
+	for name := range builtinThemes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// UnmarshalTOML accepts either the name of a built-in theme (theme = "dracula") or a table overriding single colors,
+// optionally based on a built-in theme through its Name key.
+func (t *Theme) UnmarshalTOML(data any) error {
+	switch data := data.(type) {
+	case string:
+		base, ok := builtinThemes[strings.ToLower(data)]
+		if !ok {
+			return fmt.Errorf("unknown theme %q (available: %v)", data, strings.Join(themeNames(), ", "))
+		}
+		*t = base
+	case map[string]any:
+		for key, value := range data {
+			if strings.ToLower(key) == "name" {
+				if err := t.UnmarshalTOML(value); err != nil {
+					return err
+				}
+			}
+		}
+		for key, value := range data {
+			var err error
+			switch strings.ToLower(key) {
+			case "name":
+			case "colorneutral":
+				err = t.ColorNeutral.UnmarshalTOML(value)
+			case "colorprimary":
+				err = t.ColorPrimary.UnmarshalTOML(value)
+			case "colorsecondary":
+				err = t.ColorSecondary.UnmarshalTOML(value)
+			case "colorerror":
+				err = t.ColorError.UnmarshalTOML(value)
+			case "colorprogress":
+				colors, ok := value.([]any)
+				if !ok || len(colors) != 2 {
+					return fmt.Errorf("ColorProgress must be an array of 2 colors")
+				}
+				for i := range colors {
+					if err = t.ColorProgress[i].UnmarshalTOML(colors[i]); err != nil {
+						break
+					}
+				}
+			default:
+				err = fmt.Errorf("unknown theme key %q", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("theme must be a name or a table, got %T", data)
+	}
+	return nil
+}
+
+// colorProfile is the color profile used for all output, see resolveColorProfile
+var colorProfile = termenv.TrueColor
+
+// resolveColorProfile returns the color profile for a --color mode (never, always or auto). auto honours NO_COLOR
+// and otherwise detects the terminal capabilities.
+func resolveColorProfile(mode string) (termenv.Profile, error) {
+	switch strings.ToLower(mode) {
+	case "never":
+		return termenv.Ascii, nil
+	case "always":
+		return termenv.TrueColor, nil
+	case "auto", "":
+		if os.Getenv("NO_COLOR") != "" {
+			return termenv.Ascii, nil
+		}
+		return lipgloss.ColorProfile(), nil
+	}
+	return termenv.Ascii, fmt.Errorf("invalid --color %q, expected never, always or auto", mode)
+}
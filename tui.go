@@ -1,13 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/progress"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/time/rate"
+
+	"rbcp/robocopy"
 )
 
 type UpdateMsg struct {
@@ -22,6 +25,66 @@ type ProgressMsg struct {
 
 type tickMsg struct{}
 
+// completedFile is a file robocopy finished copying with /MT
+type completedFile struct {
+	Path string
+	Size int64
+}
+
+// completingShown is how many of the last files completed with /MT are shown
+const completingShown = 3
+
+// teaObserver forwards parsed robocopy events to the TUI as messages
+type teaObserver struct {
+	p *tea.Program
+	// files are shown relative to root, the source directory of the job
+	root string
+	// limits the frequency of progress messages
+	progressLimiter *rate.Sometimes
+}
+
+func newTeaObserver(p *tea.Program, root string) teaObserver {
+	return teaObserver{p, root, &rate.Sometimes{Interval: time.Millisecond * 25}} // 1 event per N ms
+}
+
+func (o teaObserver) OnFile(e robocopy.FileEvent) {
+	path := e.Path
+	if rel, ok := robocopy.RelPath(o.root, path); ok {
+		path = filepath.FromSlash(rel)
+	}
+	o.p.Send(UpdateMsg{path, e.Size, 0})
+}
+
+func (o teaObserver) OnProgress(percent float32) {
+	if percent == 100 {
+		// always send completions
+		o.p.Send(ProgressMsg{fileProg: percent})
+		return
+	}
+	o.progressLimiter.Do(func() {
+		o.p.Send(ProgressMsg{fileProg: percent})
+	})
+}
+
+func (o teaObserver) OnDir(robocopy.FileEvent)   {}
+func (o teaObserver) OnExtra(robocopy.FileEvent) {}
+func (o teaObserver) OnSkipped(robocopy.FileEvent) {}
+
+func (o teaObserver) OnError(e robocopy.ErrorEvent) {
+	logger.Debugf("robocopy error %d %v %v: %v", e.Code, e.Action, e.Path, e.Message)
+}
+
+func (o teaObserver) OnSummary() {
+	o.p.Send(tickMsg{})
+}
+
+// noSummaryObserver keeps the TUI running when robocopy finishes, for all but the last of several jobs
+type noSummaryObserver struct {
+	robocopy.Observer
+}
+
+func (noSummaryObserver) OnSummary() {}
+
 type model struct {
 	progress    progress.Model
 	percent     float64
@@ -31,13 +94,22 @@ type model struct {
 	totalFiles  int
 	copiedBytes int64
 	copiedFiles int
+	// bytes already copied by an earlier run of a resumed job, not counted in the speed
+	resumedBytes int64
 
 	copyFinished bool
-	stats        *RobocopyStats
+	// set for the verification phase, see verify.go
+	verifying    bool
+	// threads robocopy copies with (/MT), 0 if it copies one file at a time. With /MT robocopy prints every file once it
+	// is copied, without progress, and completing holds the last ones.
+	threads      int
+	completing   []completedFile
+	stats        *robocopy.Stats
 	numTimes     int
 	numMsgs      int
 
 	totalWidth int
+	startTime  time.Time
 	ForceQuit bool
 }
 
@@ -68,6 +140,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case UpdateMsg:
 		m.numMsgs += 1
+		if msg.file != "" && m.threads > 0 {
+			msg.progress = 100
+			m.copiedBytes += msg.fileSize
+			m.completing = append(m.completing, completedFile{msg.file, msg.fileSize})
+			m.completing = m.completing[max(len(m.completing)-completingShown, 0):]
+		}
 		if msg.file != "" {
 			m.currentFile = msg
 			m.copiedFiles += 1
@@ -79,7 +157,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case ProgressMsg:
 		if msg.fileProg < m.currentFile.progress {
-			logger.Errorf("received a progress less than previous, please report this issue on github")
+			logger.Errorf("received a progress less than previous, please report this issue on github with a bug report made with --bugreport")
 			return m, nil
 		}
 		m.copiedBytes += int64(float32(m.currentFile.fileSize) * (msg.fileProg - m.currentFile.progress) / 100.0)
@@ -90,6 +168,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// }
 		return m, m.UpdatePercent()
 
+	case verifiedMsg:
+		m.currentFile = UpdateMsg{msg.file, msg.size, 100}
+		m.copiedFiles += 1
+		m.copiedBytes += msg.size
+		return m, m.UpdatePercent()
+
 	case tickMsg:
 		// logger.Printf("Received tickMsg and about to quit.")
 		m.copyFinished = true
@@ -108,33 +192,42 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m model) View() string {
-	// return ""
-	// summary := ""
-	currentFile := helpStyle.Render(
-		"Currently copying",
-		m.currentFile.file,
-		fmt.Sprintf("[%.f%% of %v]",
-			m.currentFile.progress,
-			formatByteValue(m.currentFile.fileSize),
-		),
-	)
-	if m.copyFinished {
-		// summary = fmt.Sprintf("\nProcessed %v msgs and animated %v times\n\n", m.numMsgs, m.numTimes)
-		currentFile = helpStyle.Render("Copying completed")
+	data := statusData{
+		CopiedBytes:  m.copiedBytes,
+		TotalBytes:   m.totalBytes,
+		CopiedFiles:  m.copiedFiles,
+		TotalFiles:   m.totalFiles,
+		CurrentFile:  m.currentFile.file,
+		FileSize:     m.currentFile.fileSize,
+		FileProgress: m.currentFile.progress,
+		Percent:      m.percent,
+		Elapsed:      time.Since(m.startTime),
+		Finished:     m.copyFinished,
+		Verifying:    m.verifying,
+		Threads:      m.threads,
+		Completing:   m.completing,
+		Width:        m.totalWidth,
+	}
+	if secs := data.Elapsed.Seconds(); secs > 0 {
+		data.Speed = int64(float64(m.copiedBytes-m.resumedBytes) / secs)
+	}
+	if data.Speed > 0 {
+		data.ETA = time.Duration(float64(m.totalBytes-m.copiedBytes) / float64(data.Speed) * float64(time.Second))
 	}
-	pbar := ""
 	if config.ShowProgress {
-		pbar = " " + m.progress.ViewAs(m.percent) + " \n"
+		data.Bar = m.progress.ViewAs(m.percent)
+	}
+	var b strings.Builder
+	if err := statusTemplate.Execute(&b, data); err != nil {
+		return errorStyle.Render("could not render status template: " + err.Error())
 	}
-	files := strconv.Itoa(m.copiedFiles) + "/" + strconv.Itoa(m.totalFiles)
-	bytes := fixedWidth.Render(formatByteValue(m.copiedBytes)) + "/" + fixedWidth.Render(formatByteValue(m.totalBytes))
-	// return bytes + " " + m.progress.View() + " \n" +
-	return bytes + pbar + " " + JustifyText(m.totalWidth, currentFile, files) + " \n"
-	// + summary + "\n"
+	return b.String()
 }
 
 func (m *model) UpdatePercent() tea.Cmd {
-	m.percent = float64(m.copiedBytes) / float64(m.totalBytes)
+	if m.totalBytes > 0 {
+		m.percent = float64(m.copiedBytes) / float64(m.totalBytes)
+	}
 	// logger.Printf("Update percent with %v", m.percent)
 	return nil
 }
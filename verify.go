@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+
+	"rbcp/robocopy"
+)
+
+// # Verification
+// With --verify, every file robocopy copied (or with --verify-all, every file of the source) is hashed on both sides
+// once the copy is done, in its own TUI phase. Mismatches are listed in the summary and fail the job (exit code 8).
+// With --manifest, the same phase writes the sha256 of these files in the destination to a sha256sum manifest.
+
+// hashAlgorithms are the algorithms --verify accepts
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"xxh3":   func() hash.Hash { return xxh3.New() },
+}
+
+// defaultHashAlgorithm is used for a bare --verify or --hash
+const defaultHashAlgorithm = "sha256"
+
+// verifyWorkers is the most files hashed at once
+var verifyWorkers = min(runtime.NumCPU(), 8)
+
+// verifier of the running job, nil without --verify or --manifest
+var verifier *Verifier
+
+type Verifier struct {
+	// Algorithm to verify with, empty to only write the manifest
+	Algorithm string
+	// absolute source root and destination of the job, see robocopy.Job.AbsRoot
+	root, dest string
+	// manifestPath is the file --manifest writes the sha256 of every file to, empty without it
+	manifestPath string
+	mu           sync.Mutex
+	manifest     map[string][]byte
+
+	// files copied by robocopy, relative to root, and whether their last copy failed
+	copied []string
+	sizes  map[string]int64
+	failed map[string]bool
+
+	result *verifyResult
+}
+
+// verifyResult is the outcome of the verification, shown in the summary
+type verifyResult struct {
+	Algorithm string
+	// Files were verified out of Total, fewer if the verification was stopped
+	Files      int
+	Total      int
+	Bytes      int64
+	Mismatches []verifyMismatch
+}
+
+type verifyMismatch struct {
+	// Path relative to the source root
+	Path   string
+	Reason string
+}
+
+// verifiedMsg is sent to the TUI for every file hashed on both sides
+type verifiedMsg struct {
+	file string
+	size int64
+}
+
+func newVerifier(job robocopy.Job, algorithm, manifestPath string) (*Verifier, error) {
+	if _, ok := hashAlgorithms[algorithm]; algorithm != "" && !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %v, use sha256, blake3 or xxh3", algorithm)
+	}
+	// : the sources are hashed after the copy, a manifest only hashes the destination
+	if algorithm != "" && job.Options.Moves() {
+		return nil, errors.New("--verify compares with the source, which /MOV and /MOVE delete once copied")
+	}
+	root, err := job.AbsRoot()
+	if err != nil {
+		return nil, err
+	}
+	dest, err := job.AbsDest()
+	if err != nil {
+		return nil, err
+	}
+	v := &Verifier{Algorithm: algorithm, root: root, dest: dest, manifestPath: manifestPath, sizes: make(map[string]int64),
+		failed: make(map[string]bool)}
+	if manifestPath != "" {
+		v.manifest = make(map[string][]byte)
+	}
+	return v, nil
+}
+
+// rel returns the path of a file reported by robocopy relative to the source root, or the destination
+func (v *Verifier) rel(path string) string {
+	if rel, ok := robocopy.RelPath(v.root, path); ok {
+		return rel
+	}
+	if rel, ok := robocopy.RelPath(v.dest, path); ok {
+		return rel
+	}
+	return filepath.ToSlash(path)
+}
+
+// observer wraps obs to collect the files robocopy copies
+func (v *Verifier) observer(obs robocopy.Observer) robocopy.Observer {
+	return verifyObserver{Observer: obs, v: v}
+}
+
+type verifyObserver struct {
+	robocopy.Observer
+	v *Verifier
+}
+
+func (o verifyObserver) OnFile(e robocopy.FileEvent) {
+	rel := o.v.rel(e.Path)
+	if _, ok := o.v.sizes[rel]; !ok {
+		o.v.copied = append(o.v.copied, rel)
+	}
+	o.v.sizes[rel] = e.Size
+	delete(o.v.failed, rel)
+	o.Observer.OnFile(e)
+}
+
+func (o verifyObserver) OnError(e robocopy.ErrorEvent) {
+	if e.Path != "" {
+		o.v.failed[o.v.rel(e.Path)] = true
+	}
+	o.Observer.OnError(e)
+}
+
+// files returns the files to verify with their sizes: the ones copied without errors, or all files of the job's
+// source with all
+func (v *Verifier) files(job robocopy.Job, all bool) ([]string, map[string]int64, error) {
+	if !all {
+		files := slices.DeleteFunc(slices.Clone(v.copied), func(rel string) bool { return v.failed[rel] })
+		return files, v.sizes, nil
+	}
+
+	files := make([]string, 0)
+	sizes := make(map[string]int64)
+	add := func(path string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := robocopy.RelPath(v.root, path)
+		files = append(files, rel)
+		sizes[rel] = info.Size()
+		return nil
+	}
+
+	_, names, err := job.Split()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(names) > 0 {
+		for _, name := range names {
+			matches, err := filepath.Glob(filepath.Join(v.root, name))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, path := range matches {
+				if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+					if err := add(path, fs.FileInfoToDirEntry(info)); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+		}
+		return files, sizes, nil
+	}
+
+	// : the same files robocopy considers, mostly: /XF and /XD patterns match names or full paths
+	excluded := func(patterns []string, path, name string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name))
+			return ok || strings.EqualFold(filepath.Clean(pattern), filepath.Clean(path))
+		})
+	}
+	recursive := job.Options.Recursive()
+	err = filepath.WalkDir(v.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != filepath.Clean(v.root) && (!recursive || excluded(job.Options.ExcludeDirs, path, d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || excluded(job.Options.ExcludeFiles, path, d.Name()) {
+			return nil
+		}
+		return add(path, d)
+	})
+	return files, sizes, err
+}
+
+// hashFiles runs check on every file in a pool of verifyWorkers, showing their progress in the TUI unless quiet
+func hashFiles(ctx context.Context, files []string, sizes map[string]int64, initWidth int, quiet bool,
+	check func(rel string) string) verifyResult {
+	var totalBytes int64
+	for _, rel := range files {
+		totalBytes += sizes[rel]
+	}
+	result := verifyResult{Total: len(files)}
+	if len(files) == 0 {
+		return result
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	send := func(tea.Msg) {}
+	ended := make(chan struct{})
+	if quiet {
+		close(ended)
+	} else {
+		m := newModel(len(files), totalBytes, initWidth)
+		m.verifying = true
+		p = tea.NewProgram(m)
+		send = p.Send
+		go func() {
+			defer close(ended)
+			if t, err := p.Run(); err != nil {
+				logger.Fatal("error running program:", err)
+			} else if t.(model).ForceQuit {
+				cancel()
+			}
+		}()
+	}
+
+	queue := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range verifyWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range queue {
+				reason := check(rel)
+				mu.Lock()
+				result.Files++
+				result.Bytes += sizes[rel]
+				if reason != "" {
+					result.Mismatches = append(result.Mismatches, verifyMismatch{Path: rel, Reason: reason})
+				}
+				mu.Unlock()
+				send(verifiedMsg{filepath.FromSlash(rel), sizes[rel]})
+			}
+		}()
+	}
+feed:
+	for _, rel := range files {
+		select {
+		case queue <- rel:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if !quiet {
+		p.Send(tickMsg{})
+		p.Wait()
+	}
+	<-ended
+
+	slices.SortFunc(result.Mismatches, func(a, b verifyMismatch) int { return strings.Compare(a.Path, b.Path) })
+	return result
+}
+
+// check verifies a copied file (with --verify) and hashes it for the manifest (with --manifest), returning why it
+// does not match the source or an empty string
+func (v *Verifier) check(rel string) string {
+	var reason string
+	var sum []byte
+	if v.Algorithm != "" {
+		reason, sum = v.compare(rel)
+		if v.Algorithm != "sha256" {
+			sum = nil
+		}
+	}
+	if v.manifest == nil || reason != "" {
+		return reason
+	}
+	if sum == nil {
+		var err error
+		if sum, err = hashFile(filepath.Join(v.dest, rel), sha256.New); err != nil {
+			return "cannot read the destination: " + err.Error()
+		}
+	}
+	v.mu.Lock()
+	v.manifest[rel] = sum
+	v.mu.Unlock()
+	return ""
+}
+
+// compare hashes a file in the source and the destination, returning why they differ (or an empty string) and the
+// hash of the destination
+func (v *Verifier) compare(rel string) (string, []byte) {
+	src, dst := filepath.Join(v.root, rel), filepath.Join(v.dest, rel)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "cannot read the source: " + err.Error(), nil
+	}
+	dstInfo, err := os.Stat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing in the destination", nil
+	} else if err != nil {
+		return "cannot read the destination: " + err.Error(), nil
+	}
+	if srcInfo.Size() != dstInfo.Size() {
+		return fmt.Sprintf("size differs (%v in the source, %v in the destination)",
+			formatByteValue(srcInfo.Size()), formatByteValue(dstInfo.Size())), nil
+	}
+	srcSum, err := hashFile(src, hashAlgorithms[v.Algorithm])
+	if err != nil {
+		return "cannot read the source: " + err.Error(), nil
+	}
+	dstSum, err := hashFile(dst, hashAlgorithms[v.Algorithm])
+	if err != nil {
+		return "cannot read the destination: " + err.Error(), nil
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return v.Algorithm + " differs", dstSum
+	}
+	return "", dstSum
+}
+
+// hashFile returns the hash of the contents of a file
+func hashFile(path string, newHash func() hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyCopy runs the verification and manifest phase after a copy, adding exit code 8 to stats on any mismatch
+func verifyCopy(ctx context.Context, stats *robocopy.Stats, initWidth int) {
+	files, sizes, err := verifier.files(job, args.VerifyAll)
+	if err != nil {
+		logger.Errorf("Could not list the files to verify: %v", err)
+		stats.ExitCode |= 8
+		return
+	}
+	result := hashFiles(ctx, files, sizes, initWidth, false, verifier.check)
+	result.Algorithm = verifier.Algorithm
+	if verifier.Algorithm != "" {
+		verifier.result = &result
+	}
+	if len(result.Mismatches) > 0 || result.Files < result.Total {
+		stats.ExitCode |= 8
+	}
+
+	if verifier.manifestPath != "" {
+		if err := writeManifest(verifier.manifestPath, verifier.manifest); err != nil {
+			logger.Errorf("Could not write the manifest: %v", err)
+			stats.ExitCode |= 16
+		} else {
+			fmt.Println("Wrote the sha256 of " + impStyle.Render(fmt.Sprintf("%d files", len(verifier.manifest))) +
+				" to " + pathStyle.Render(verifier.manifestPath))
+		}
+	}
+}
+
+// withDefaultHash turns a bare flag, e.g. --verify, into --verify=sha256, as go-arg has no flags with an optional
+// value
+func withDefaultHash(argv []string, flag string) []string {
+	out := slices.Clone(argv)
+	for i, a := range out {
+		if a == "--" || a == "-[" || a == "--passthrough" {
+			break
+		}
+		if a != flag {
+			continue
+		}
+		// : unless the algorithm is the next argument
+		if i+1 < len(out) {
+			if _, ok := hashAlgorithms[out[i+1]]; ok {
+				continue
+			}
+		}
+		out[i] = flag + "=" + defaultHashAlgorithm
+	}
+	return out
+}